@@ -5,8 +5,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"exp.upspin.io/internal/logformat"
+
+	"upspin.io/bind"
+	"upspin.io/client"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
 	"upspin.io/pack"
 	"upspin.io/test/testenv"
 	"upspin.io/upspin"
@@ -115,6 +131,211 @@ func TestIntegration(t *testing.T) {
 	}
 }
 
+// TestFixSummary checks that the fixes made back to back after an Access
+// change are reported in a single summary for their directory.
+func TestFixSummary(t *testing.T) {
+	const (
+		name  = "test@example.com"
+		other = "aly@example.net"
+		dir   = name + "/dir"
+		n     = 5
+	)
+	env, err := testenv.New(&testenv.Setup{
+		OwnerName: name,
+		Kind:      "server",
+		Packing:   upspin.EEPack,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Exit()
+
+	_, err = env.NewUser(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := testenv.NewRunner()
+	r.AddUser(env.Config)
+	r.As(name)
+	r.MakeDirectory(dir)
+	for i := 0; i < n; i++ {
+		r.Put(upspin.PathName(fmt.Sprintf("%s/file%d", dir, i)), "some content")
+	}
+	if r.Failed() {
+		t.Fatal(r.Diag())
+	}
+
+	var out syncBuffer
+	if err := logformat.Set(logformat.JSON, "test", &out); err != nil {
+		t.Fatal(err)
+	}
+	defer logformat.Set(logformat.Text, "", os.Stderr)
+
+	w, err := NewWatcher(env.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Shutdown()
+
+	r.Put(dir+"/Access", "*:"+name+"\nr:"+other)
+	if r.Failed() {
+		t.Fatal(r.Diag())
+	}
+	want := fmt.Sprintf("fixed %d files under %s", n, dir)
+	for i := 0; !strings.Contains(out.String(), want); i++ {
+		if i == 500 {
+			t.Fatalf("no %q in log:\n%s", want, out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Allow time for any stray summary of part of the burst to appear.
+	time.Sleep(200 * time.Millisecond)
+	if got := strings.Count(out.String(), `"event":"fixed"`); got != 1 {
+		t.Errorf("got %d fix summaries, want 1; log:\n%s", got, out.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestSelfRewrap checks that after the owner rotates their key, keeping the
+// old one in their factotum, a file wrapped only for the old key is
+// rewrapped for the new one even though its set of readers is unchanged.
+func TestSelfRewrap(t *testing.T) {
+	const name = "test@example.com"
+	env, err := testenv.New(&testenv.Setup{
+		OwnerName: name,
+		Kind:      "server",
+		Packing:   upspin.EEPack,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Exit()
+
+	keyDir, err := ioutil.TempDir("", "sharebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	// Give the owner a first key and write the file with it.
+	_, cfg1 := newKey(t, env.Config, keyDir, false)
+
+	r := testenv.NewRunner()
+	r.AddUser(env.Config)
+
+	const (
+		dir        = name + "/dir"
+		file       = dir + "/file"
+		accessFile = dir + "/Access"
+	)
+
+	r.As(name)
+	r.MakeDirectory(dir)
+	if r.Failed() {
+		t.Fatal(r.Diag())
+	}
+	if _, err := client.New(cfg1).Put(file, []byte("some content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to a second key, keeping the first in the factotum.
+	pub2, cfg2 := newKey(t, cfg1, keyDir, true)
+
+	w, err := NewWatcher(cfg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Shutdown()
+
+	done := r.DirWatch(name, -1)
+	defer close(done)
+	r.GetNEvents(3)
+	r.GotEvent(file, true)
+	if r.Failed() {
+		t.Fatal(r.Diag())
+	}
+	if hs, ok := readerHashes(r, file); !ok || len(hs) != 1 {
+		t.Fatalf("got hashes %x for %q, want 1", hs, file)
+	}
+
+	// An Access file naming only the owner leaves the readers as they were,
+	// but prompts a check of the file, which must be rewrapped for self.
+	r.Put(accessFile, "*:"+name)
+	r.GetNEvents(1)
+	r.GotEvent(accessFile, true)
+	r.GetNEvents(1)
+	r.GotEvent(file, true)
+	if r.Failed() {
+		t.Fatal(r.Diag())
+	}
+	hs, _ := readerHashes(r, file)
+	want := sha256.Sum256([]byte(pub2))
+	if len(hs) != 1 || !bytes.Equal(hs[0], want[:]) {
+		t.Fatalf("got hashes %x for %q, want only the new key's %x", hs, file, want)
+	}
+}
+
+// newKey generates a key pair for the user of cfg, saves it in keyDir,
+// archiving the previous keys there if rotate is set, and registers it with
+// the key server. It returns the public key and cfg with a factotum for it.
+func newKey(t *testing.T, cfg upspin.Config, keyDir string, rotate bool) (upspin.PublicKey, upspin.Config) {
+	pub, priv, secret, err := keygen.Generate("p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keygen.SaveKeys(keyDir, rotate, pub, priv, secret); err != nil {
+		t.Fatal(err)
+	}
+	f, err := factotum.NewFromDir(keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Register the key as the user of cfg, who holds the key to replace.
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := key.Lookup(cfg.UserName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.PublicKey = upspin.PublicKey(pub)
+	if err := key.Put(u); err != nil {
+		t.Fatal(err)
+	}
+	return upspin.PublicKey(pub), config.SetFactotum(cfg, f)
+}
+
+// readerHashes returns the reader key hashes of the entry for name in the
+// events last received by r, and reports whether there was one.
+func readerHashes(r *testenv.Runner, name upspin.PathName) ([][]byte, bool) {
+	for _, e := range r.Events {
+		if e.Entry.Name == name {
+			hs, _ := pack.Lookup(upspin.EEPack).ReaderHashes(e.Entry.Packdata)
+			return hs, true
+		}
+	}
+	return nil, false
+}
+
 func numHashes(r *testenv.Runner, name upspin.PathName) int {
 	for _, e := range r.Events {
 		if e.Entry.Name == name {
@@ -124,3 +345,145 @@ func numHashes(r *testenv.Runner, name upspin.PathName) int {
 	}
 	return -1
 }
+
+// errorWatchDir is a DirServer whose Watch delivers a single error event.
+type errorWatchDir struct {
+	upspin.DirServer
+	err error
+}
+
+func (d errorWatchDir) Watch(name upspin.PathName, seq int64, done <-chan struct{}) (<-chan upspin.Event, error) {
+	events := make(chan upspin.Event, 1)
+	events <- upspin.Event{Error: d.err}
+	return events, nil
+}
+
+func TestWatchErrorEvent(t *testing.T) {
+	w := &Watcher{
+		cfg:      config.SetUserName(config.New(), "test@example.com"),
+		dir:      errorWatchDir{err: errors.E(errors.IO, errors.Str("connection lost"))},
+		shutdown: make(chan struct{}),
+	}
+	err := w.watch()
+	if err == nil {
+		t.Fatal("watch returned nil error after an error event")
+	}
+	if !strings.Contains(err.Error(), "connection lost") {
+		t.Errorf("watch error = %q, want it to mention %q", err, "connection lost")
+	}
+}
+
+func TestBufferBackPressure(t *testing.T) {
+	const max = 10
+	w := &Watcher{
+		maxPending: max,
+		buffer:     make(chan upspin.PathName),
+		check:      make(chan upspin.PathName),
+		finished:   make(chan upspin.PathName),
+		shutdown:   make(chan struct{}),
+	}
+	go w.bufferLoop()
+	defer close(w.shutdown)
+
+	send := func(name upspin.PathName, wait time.Duration) bool {
+		select {
+		case w.buffer <- name:
+			return true
+		case <-time.After(wait):
+			return false
+		}
+	}
+	for i := 0; i < max; i++ {
+		if !send(upspin.PathName(fmt.Sprintf("test@example.com/%d", i)), 5*time.Second) {
+			t.Fatalf("send blocked with %d files pending, want room for %d", i, max)
+		}
+	}
+	// A flood of further events must wait rather than pile up.
+	if send("test@example.com/extra", 100*time.Millisecond) {
+		t.Fatalf("send succeeded with %d files pending", max)
+	}
+	// Checking one file makes room for one more.
+	<-w.check
+	if !send("test@example.com/extra", 5*time.Second) {
+		t.Fatal("send blocked after a pending file was checked")
+	}
+	if send("test@example.com/more", 100*time.Millisecond) {
+		t.Fatalf("send succeeded with %d files pending", max)
+	}
+}
+
+func TestWrappedFor(t *testing.T) {
+	s := &Sharer{excluded: map[upspin.UserName]bool{"bot@example.com": true}}
+	readers := userList{"ann@example.com", "bot@example.com", "bob@example.com"}
+	got := s.wrappedFor(readers).String()
+	if want := "ann@example.com bob@example.com"; got != want {
+		t.Errorf("wrappedFor(%v) = %q, want %q", readers, got, want)
+	}
+}
+
+func TestBufferDefersInProgress(t *testing.T) {
+	w := &Watcher{
+		maxPending: 10,
+		buffer:     make(chan upspin.PathName),
+		check:      make(chan upspin.PathName),
+		finished:   make(chan upspin.PathName),
+		shutdown:   make(chan struct{}),
+	}
+	go w.bufferLoop()
+	defer close(w.shutdown)
+
+	const name = "test@example.com/file"
+	w.buffer <- name
+	if got := <-w.check; got != name {
+		t.Fatalf("checked %q, want %q", got, name)
+	}
+	// The same name arrives while its file is being checked.
+	w.buffer <- name
+	select {
+	case got := <-w.check:
+		t.Fatalf("checked %q again before the first check finished", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Once that check finishes, the file is checked again.
+	w.finished <- name
+	select {
+	case got := <-w.check:
+		if got != name {
+			t.Fatalf("checked %q, want %q", got, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("name received during its check was dropped")
+	}
+}
+
+func TestBufferIdle(t *testing.T) {
+	w := &Watcher{
+		maxPending: 10,
+		buffer:     make(chan upspin.PathName),
+		check:      make(chan upspin.PathName),
+		finished:   make(chan upspin.PathName),
+		idle:       make(chan struct{}),
+		shutdown:   make(chan struct{}),
+	}
+	go w.bufferLoop()
+	defer close(w.shutdown)
+
+	w.buffer <- "test@example.com/a"
+	w.buffer <- "test@example.com/b"
+	// Finishing the first check must not report idle while the
+	// second file waits.
+	w.finished <- <-w.check
+	select {
+	case name := <-w.check:
+		w.finished <- name
+	case <-w.idle:
+		t.Fatal("idle reported with a file waiting")
+	}
+	select {
+	case <-w.idle:
+	case name := <-w.check:
+		t.Fatalf("checked %q with no file waiting", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle not reported once no files were waiting")
+	}
+}
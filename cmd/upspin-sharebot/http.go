@@ -0,0 +1,154 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// serveHTTP serves the Watcher's monitoring and admin endpoints on the given
+// address, which must be a loopback address. It only returns on failure.
+//
+//	/events		a stream of server-sent events, each an Event encoded as JSON
+//	/recheck?path=p	POST to check p, or for a directory its subtree, for
+//			inconsistencies, as if it had just changed
+func (w *Watcher) serveHTTP(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.Errorf("http address %s is not a loopback address", addr)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/events", &w.events)
+	mux.HandleFunc("/recheck", w.serveRecheck)
+	return http.ListenAndServe(addr, mux)
+}
+
+// serveRecheck queues the named file, or the files below the named
+// directory, for checking.
+func (w *Watcher) serveRecheck(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "recheck requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	p, err := path.Parse(upspin.PathName(r.FormValue("path")))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.User() != w.cfg.UserName() {
+		http.Error(rw, "path is outside the watched root", http.StatusBadRequest)
+		return
+	}
+	name := p.Path()
+	e, err := w.dir.Lookup(name)
+	if errors.Is(errors.NotExist, err) {
+		http.NotFound(rw, r)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info.Printf("watcher: recheck requested for %v", name)
+	if e.IsDir() {
+		go w.checkDir(name)
+	} else {
+		select {
+		case w.buffer <- name:
+		case <-w.shutdown:
+			http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(rw, "queued %s\n", name)
+}
+
+// Event describes something done by the Watcher, for live monitoring.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"` // "fix" or "reconnect".
+
+	// For fix events, the file that was fixed and how its readers changed.
+	Name    upspin.PathName   `json:"name,omitempty"`
+	Added   []upspin.UserName `json:"added,omitempty"`
+	Removed []upspin.UserName `json:"removed,omitempty"`
+
+	// For reconnect events, why the previous watch ended, if known.
+	Error string `json:"error,omitempty"`
+}
+
+// eventStream is an http.Handler that streams published Events to its
+// clients as server-sent events. Publishing never blocks; a client that
+// falls too far behind misses events. The zero value is ready to use.
+type eventStream struct {
+	mu      sync.Mutex
+	clients map[chan Event]bool
+}
+
+// publish sends e to all connected clients, stamping it with the current time.
+func (s *eventStream) publish(e Event) {
+	e.Time = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *eventStream) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c := make(chan Event, 100)
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[chan Event]bool)
+	}
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		select {
+		case e := <-c:
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Error.Printf("watcher: encoding event: %v", err)
+				continue
+			}
+			fmt.Fprintf(rw, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -9,16 +9,20 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"flag"
 	"fmt"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"exp.upspin.io/internal/cmdconfig"
+	"exp.upspin.io/internal/logformat"
+
 	"upspin.io/access"
 	"upspin.io/bind"
 	"upspin.io/client"
-	"upspin.io/config"
 	"upspin.io/errors"
 	"upspin.io/factotum"
 	"upspin.io/flags"
@@ -27,22 +31,46 @@ import (
 	"upspin.io/path"
 	"upspin.io/shutdown"
 	"upspin.io/upspin"
+	"upspin.io/user"
 
 	_ "upspin.io/transports"
 )
 
 func main() {
+	httpAddr := flag.String("http", "", "serve monitoring and admin endpoints on this loopback `address` (host:port)")
+	logFormat := flag.String("logformat", logformat.Text, "`format` of log lines: text, or json for log aggregators")
+	exclude := flag.String("exclude-readers", "", "comma-separated list of `users` never given keys, even if Access files make them readers")
+	flag.IntVar(&maxPending, "max-pending", maxPending, "maximum `number` of files waiting to be checked; when reached, watching pauses until some are checked")
+	heartbeat := flag.Duration("heartbeat", 10*time.Minute, "log a heartbeat line reporting liveness and activity at this `interval` (0 disables)")
 	flags.Parse(flags.Client)
+	if err := logformat.Set(*logFormat, "upspin-sharebot", os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+	if maxPending < 1 {
+		log.Fatalf("-max-pending must be at least 1")
+	}
+	if err := parseExcluded(*exclude); err != nil {
+		log.Fatal(err)
+	}
 
-	cfg, err := config.FromFile(flags.Config)
+	cfg, err := cmdconfig.FromFlag(flags.Config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if excludedReaders[cfg.UserName()] {
+		log.Fatalf("-exclude-readers: cannot exclude the owner %s", cfg.UserName())
+	}
 	w, err := NewWatcher(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	shutdown.Handle(w.Shutdown)
+	if *heartbeat > 0 {
+		go w.heartbeatLoop(*heartbeat)
+	}
+	if *httpAddr != "" {
+		log.Fatal(w.serveHTTP(*httpAddr))
+	}
 	select {}
 }
 
@@ -55,13 +83,82 @@ type Watcher struct {
 
 	seq int64 // owned by watch
 
+	maxPending int // Limit on the files held by bufferLoop.
+
 	buffer   chan upspin.PathName
 	check    chan upspin.PathName
-	shutdown chan struct{} // closed to signal shutdown
-	done     chan struct{} // closed when checkLoop exits
+	finished chan upspin.PathName // names whose check is complete
+	idle     chan struct{}        // ready while no files wait to be checked
+	shutdown chan struct{}        // closed to signal shutdown
+	done     chan struct{}        // closed when checkLoop exits
 
 	mu sync.Mutex
 	s  *Sharer
+
+	events eventStream // Reports fixes and reconnections to monitors.
+
+	statsMu sync.Mutex
+	stats   watchStats // Activity since the last heartbeat.
+}
+
+// watchStats counts the activity of a Watcher for its heartbeat.
+type watchStats struct {
+	seq     int64 // Sequence number of the latest event received.
+	events  int   // Events received.
+	checked int   // Files checked.
+	fixed   int   // Files fixed.
+}
+
+// count applies f to the Watcher's activity counts.
+func (w *Watcher) count(f func(*watchStats)) {
+	w.statsMu.Lock()
+	f(&w.stats)
+	w.statsMu.Unlock()
+}
+
+// heartbeatLoop logs a line every interval reporting that the Watcher is
+// alive, with its watch sequence, cache sizes, and activity since the
+// previous line, so that log monitoring can alert when the lines stop.
+func (w *Watcher) heartbeatLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.shutdown:
+			return
+		}
+		w.statsMu.Lock()
+		st := w.stats
+		w.stats = watchStats{seq: st.seq}
+		w.statsMu.Unlock()
+		w.mu.Lock()
+		nAccess, nUsers, nKeys := len(w.s.accessFiles), len(w.s.users), len(w.s.userKeys)
+		w.mu.Unlock()
+		logformat.Event("info", fmt.Sprintf("watcher: heartbeat: seq=%d events=%d checked=%d fixed=%d; cached access=%d users=%d keys=%d",
+			st.seq, st.events, st.checked, st.fixed, nAccess, nUsers, nKeys),
+			"event", "heartbeat", "seq", st.seq, "events", st.events, "checked", st.checked, "fixed", st.fixed,
+			"cachedAccess", nAccess, "cachedUsers", nUsers, "cachedKeys", nKeys)
+	}
+}
+
+// excludedReaders holds the users never given keys, even if they are readers.
+var excludedReaders = make(map[upspin.UserName]bool)
+
+// parseExcluded parses the value of the -exclude-readers flag
+// into excludedReaders.
+func parseExcluded(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		u := upspin.UserName(strings.TrimSpace(name))
+		if _, _, _, err := user.Parse(u); err != nil {
+			return errors.E("-exclude-readers", err)
+		}
+		excludedReaders[u] = true
+	}
+	return nil
 }
 
 // NewWatcher initializes, starts, and returns a new Watcher for the user in
@@ -85,8 +182,12 @@ func NewWatcher(cfg upspin.Config) (*Watcher, error) {
 
 		seq: upspin.WatchCurrent,
 
+		maxPending: maxPending,
+
 		buffer:   make(chan upspin.PathName),
 		check:    make(chan upspin.PathName),
+		finished: make(chan upspin.PathName),
+		idle:     make(chan struct{}),
 		shutdown: make(chan struct{}),
 		done:     make(chan struct{}),
 
@@ -98,28 +199,57 @@ func NewWatcher(cfg upspin.Config) (*Watcher, error) {
 	return w, nil
 }
 
+// maxPending is the default limit on the files waiting to be checked.
+var maxPending = 10000
+
 // bufferLoop receives path names from buffer and sends them to check,
-// buffering and de-duplicating them in between.
+// buffering and de-duplicating them in between. A name received while
+// its file is being checked is held back until that check completes, so
+// that the file is not checked twice at once but no change is missed. Once
+// maxPending files are waiting it stops receiving, blocking the producers
+// until check takes some. While no files are waiting it offers a send on
+// idle, which tells checkLoop that a burst of checks is over.
 func (w *Watcher) bufferLoop() {
 	defer close(w.check)
 	files := make(map[upspin.PathName]bool)
+	inProgress := make(map[upspin.PathName]bool)
+	deferred := make(map[upspin.PathName]bool) // Received while in progress.
 	for {
 		var name upspin.PathName
 		var check chan upspin.PathName
+		idle := w.idle
 		if len(files) > 0 {
 			// Pick one entry at random from the files map.
 			for name = range files {
 				break
 			}
 			check = w.check
+			idle = nil
+		}
+		buffer := w.buffer
+		if len(files) >= w.maxPending {
+			buffer = nil
 		}
 		select {
 		case check <- name:
 			delete(files, name)
-		case newName, active := <-w.buffer:
+			inProgress[name] = true
+		case idle <- struct{}{}:
+		case name := <-w.finished:
+			delete(inProgress, name)
+			if deferred[name] {
+				delete(deferred, name)
+				files[name] = true
+			}
+		case newName, active := <-buffer:
 			if !active {
 				return
 			}
+			if inProgress[newName] {
+				log.Debug.Printf("watcher: %v: being checked; will check again", newName)
+				deferred[newName] = true
+				continue
+			}
 			files[newName] = true
 		case <-w.shutdown:
 			return
@@ -129,40 +259,151 @@ func (w *Watcher) bufferLoop() {
 
 // checkLoop receives path names from check, inspects each for inconsistencies
 // between readers and wrapped keys, and fixes them if found.
+// Fixes are logged individually at debug level and summarized by directory
+// at info level whenever bufferLoop reports that no more files are waiting.
 func (w *Watcher) checkLoop() {
 	defer close(w.done)
-	for name := range w.check {
-		e, err := w.dir.Lookup(name)
-		if errors.Is(errors.NotExist, err) {
-			log.Debug.Printf("watcher: %v: no longer exists; skipping", name)
-			continue
+	fixes := make(map[upspin.PathName]*fixSummary)
+	for {
+		var name upspin.PathName
+		var ok bool
+		select {
+		case name, ok = <-w.check:
+		case <-w.idle:
+			// Nothing more to check for now; report this burst of fixes.
+			logFixes(fixes)
+			name, ok = <-w.check
 		}
-		if err != nil {
-			log.Error.Print(err)
-			continue
+		if !ok {
+			logFixes(fixes)
+			return
 		}
-		if e.Packing != upspin.EEPack {
-			log.Debug.Printf("watcher: %v: unknown packing %v", e.Name, e.Packing)
-			continue
+		w.checkFile(name, fixes)
+		w.finish(name)
+	}
+}
+
+// checkFile inspects the named file for inconsistencies between readers and
+// wrapped keys and fixes them if found, recording the fix in fixes.
+func (w *Watcher) checkFile(name upspin.PathName, fixes map[upspin.PathName]*fixSummary) {
+	w.count(func(st *watchStats) { st.checked++ })
+	e, err := w.dir.Lookup(name)
+	if errors.Is(errors.NotExist, err) {
+		log.Debug.Printf("watcher: %v: no longer exists; skipping", name)
+		return
+	}
+	if err != nil {
+		log.Error.Print(err)
+		return
+	}
+	if e.Packing != upspin.EEPack {
+		log.Debug.Printf("watcher: %v: unknown packing %v", e.Name, e.Packing)
+		return
+	}
+	w.mu.Lock()
+	readers, keyUsers, self, err := w.s.readers(e)
+	w.mu.Unlock()
+	if err != nil {
+		log.Error.Print("watcher: ", err)
+		return
+	}
+	// The users who should hold keys.
+	want := w.s.wrappedFor(readers)
+	msg := fmt.Sprintf("%v self=%v\n\treaders: %v\n\tkeys: %v", e.Name, self, readers, keyUsers)
+	if !self && want.String() == keyUsers.String() {
+		log.Debug.Print("watcher: ", msg)
+		return
+	}
+	logformat.Event("debug", "watcher: fixing inconsistency: "+msg,
+		"event", "fixing", "file", e.Name, "self", self, "readers", len(readers), "keys", len(keyUsers))
+	w.mu.Lock()
+	err = w.s.fixShare(e, readers)
+	w.mu.Unlock()
+	if err != nil {
+		log.Error.Print("watcher: ", err)
+		return
+	}
+	w.count(func(st *watchStats) { st.fixed++ })
+	added, removed := diffUsers(want, keyUsers)
+	w.events.publish(Event{Kind: "fix", Name: e.Name, Added: added, Removed: removed})
+	dir := path.DropPath(e.Name, 1)
+	f, ok := fixes[dir]
+	if !ok {
+		f = &fixSummary{
+			added:   make(map[upspin.UserName]bool),
+			removed: make(map[upspin.UserName]bool),
 		}
-		w.mu.Lock()
-		readers, keyUsers, self, err := w.s.readers(e)
-		w.mu.Unlock()
-		if err != nil {
-			log.Error.Print("watcher: ", err)
-			continue
+		fixes[dir] = f
+	}
+	f.add(want, keyUsers)
+}
+
+// finish tells bufferLoop that the check of the named file is complete.
+func (w *Watcher) finish(name upspin.PathName) {
+	select {
+	case w.finished <- name:
+	case <-w.shutdown:
+	}
+}
+
+// fixSummary accumulates the fixes made to the files of one directory.
+type fixSummary struct {
+	files   int
+	added   map[upspin.UserName]bool // Readers given keys.
+	removed map[upspin.UserName]bool // Key holders no longer readers.
+}
+
+// add records a fix that changed a file's key holders from keyUsers to readers.
+func (f *fixSummary) add(readers, keyUsers userList) {
+	f.files++
+	added, removed := diffUsers(readers, keyUsers)
+	for _, u := range added {
+		f.added[u] = true
+	}
+	for _, u := range removed {
+		f.removed[u] = true
+	}
+}
+
+// diffUsers returns the readers that lack keys and the key holders that
+// are no longer readers.
+func diffUsers(readers, keyUsers userList) (added, removed []upspin.UserName) {
+	for _, u := range readers {
+		if !keyUsers.contains(u) {
+			added = append(added, u)
 		}
-		msg := fmt.Sprintf("%v self=%v\n\treaders: %v\n\tkeys: %v", e.Name, self, readers, keyUsers)
-		if !self && readers.String() == keyUsers.String() {
-			log.Debug.Print("watcher: ", msg)
-			continue
+	}
+	for _, u := range keyUsers {
+		if !readers.contains(u) {
+			removed = append(removed, u)
 		}
-		log.Info.Printf("watcher: fixing inconsistency: %v", msg)
-		w.mu.Lock()
-		if err := w.s.fixShare(e, readers); err != nil {
-			log.Error.Print("watcher: ", err)
+	}
+	return added, removed
+}
+
+// logFixes logs a summary line for each directory in fixes and then empties it.
+func logFixes(fixes map[upspin.PathName]*fixSummary) {
+	var dirs []string
+	for dir := range fixes {
+		dirs = append(dirs, string(dir))
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		f := fixes[upspin.PathName(dir)]
+		var changes []string
+		added, removed := userSet(f.added).String(), userSet(f.removed).String()
+		if len(f.added) > 0 {
+			changes = append(changes, "added "+added)
 		}
-		w.mu.Unlock()
+		if len(f.removed) > 0 {
+			changes = append(changes, "removed "+removed)
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "rewrapped for self")
+		}
+		logformat.Event("info", fmt.Sprintf("watcher: fixed %d files under %s (%s)", f.files, dir, strings.Join(changes, ", ")),
+			"event", "fixed", "dir", dir, "files", f.files, "added", added, "removed", removed)
+		delete(fixes, upspin.PathName(dir))
 	}
 }
 
@@ -170,14 +411,20 @@ func (w *Watcher) checkLoop() {
 func (w *Watcher) watchLoop() {
 	for {
 		dialed := time.Now()
-		if err := w.watch(); err != nil {
-			log.Error.Printf("watcher: %v", err)
+		err := w.watch()
+		if err != nil {
+			logformat.Event("error", fmt.Sprintf("watcher: %v", err), "event", "watch", "error", err)
 		}
 		select {
 		case <-w.shutdown:
 			return
 		default:
 		}
+		reconnect := Event{Kind: "reconnect"}
+		if err != nil {
+			reconnect.Error = err.Error()
+		}
+		w.events.publish(reconnect)
 		// Wait a minute between watches.
 		const wait = 1 + time.Minute
 		if elapsed := time.Since(dialed); elapsed < wait {
@@ -211,10 +458,14 @@ func (w *Watcher) watch() error {
 			return nil
 		}
 		if e.Error != nil {
-			return err
+			return errors.E(name, e.Error)
 		}
 		log.Debug.Printf("watcher: received event: %v delete=%t seq=%d", e.Entry.Name, e.Delete, e.Entry.Sequence)
 		w.seq = e.Entry.Sequence
+		w.count(func(st *watchStats) {
+			st.seq = e.Entry.Sequence
+			st.events++
+		})
 		if e.Entry.IsDir() {
 			continue
 		}
@@ -307,6 +558,9 @@ type Sharer struct {
 
 	// userByHash maps the SHA-256 hashes of each user's key to the user name.
 	userByHash map[[sha256.Size]byte]upspin.UserName
+
+	// excluded holds the readers never to be given keys.
+	excluded map[upspin.UserName]bool
 }
 
 func newSharer(cfg upspin.Config, dir upspin.DirServer, key upspin.KeyServer) *Sharer {
@@ -320,9 +574,24 @@ func newSharer(cfg upspin.Config, dir upspin.DirServer, key upspin.KeyServer) *S
 		users:       make(map[upspin.PathName]userList),
 		userKeys:    make(map[upspin.UserName]upspin.PublicKey),
 		userByHash:  make(map[[sha256.Size]byte]upspin.UserName),
+		excluded:    excludedReaders,
 	}
 }
 
+// wrappedFor returns the readers who should hold keys: all but the excluded.
+func (s *Sharer) wrappedFor(readers userList) userList {
+	if len(s.excluded) == 0 {
+		return readers
+	}
+	want := make(userList, 0, len(readers))
+	for _, u := range readers {
+		if !s.excluded[u] {
+			want = append(want, u)
+		}
+	}
+	return want
+}
+
 // readers returns two lists, the list of users with access according to the
 // access file, and the the pretty-printed string of user names recovered from
 // looking at the list of hashed keys in the packdata.
@@ -332,24 +601,8 @@ func (s *Sharer) readers(entry *upspin.DirEntry) (users, keyUsers userList, self
 		// Directories don't have readers.
 		return nil, nil, self, nil
 	}
-	p, _ := path.Parse(entry.Name)
-	for {
-		p = p.Drop(1)
-		var ok bool
-		users, ok = s.users[p.Path()]
-		if ok {
-			break
-		}
-		if p.IsRoot() {
-			users = userList{p.User()}
-			break
-		}
-	}
-	for _, user := range users {
-		if _, err := s.lookupKey(user); err != nil {
-			log.Error.Printf("watcher: %v: %v", entry.Name, err)
-		}
-	}
+	users = s.accessUsers(entry.Name)
+	s.lookupKeys(entry.Name, users)
 	packer := s.lookupPacker(entry)
 	if packer == nil {
 		return users, nil, self, errors.Errorf("no packer registered for packer %s", entry.Packing)
@@ -395,6 +648,21 @@ func (s *Sharer) readers(entry *upspin.DirEntry) (users, keyUsers userList, self
 	return users, keyUsers, self, nil
 }
 
+// accessUsers returns the readers of the named file according to the
+// Access file that governs it, or just its owner if there is none.
+func (s *Sharer) accessUsers(name upspin.PathName) userList {
+	p, _ := path.Parse(name)
+	for {
+		p = p.Drop(1)
+		if users, ok := s.users[p.Path()]; ok {
+			return users
+		}
+		if p.IsRoot() {
+			return userList{p.User()}
+		}
+	}
+}
+
 // lookupPacker returns the Packer implementation for the entry, or
 // nil if none is available.
 func (s *Sharer) lookupPacker(entry *upspin.DirEntry) upspin.Packer {
@@ -455,6 +723,10 @@ func (s *Sharer) fixShare(entry *upspin.DirEntry, users userList) error {
 			all = true
 			continue
 		}
+		if s.excluded[user] {
+			log.Debug.Printf("watcher: %v: not wrapping key for %v, excluded by -exclude-readers", entry.Name, user)
+			continue
+		}
 		// Erroneous or wildcard users will have empty keys here, and be ignored.
 		k, err := s.lookupKey(user)
 		if err != nil {
@@ -496,17 +768,62 @@ func (s *Sharer) lookupKey(user upspin.UserName) (upspin.PublicKey, error) {
 		return "", nil
 	}
 	u, err := s.key.Lookup(user)
+	return s.cacheKey(user, u, err)
+}
+
+// maxKeyLookups limits the number of concurrent KeyServer lookups
+// made by lookupKeys.
+const maxKeyLookups = 8
+
+// lookupKeys looks up, in parallel, the public keys of those users whose
+// keys are not already cached, and caches the results. Failed lookups
+// are logged as errors concerning the named file.
+func (s *Sharer) lookupKeys(name upspin.PathName, users userList) {
+	var todo []upspin.UserName
+	for _, user := range users {
+		if _, ok := s.userKeys[user]; ok || user == access.AllUsers || isWildcardUser(user) {
+			continue
+		}
+		todo = append(todo, user)
+	}
+	type result struct {
+		u   *upspin.User
+		err error
+	}
+	results := make([]result, len(todo))
+	sem := make(chan bool, maxKeyLookups)
+	var wg sync.WaitGroup
+	for i, user := range todo {
+		wg.Add(1)
+		sem <- true
+		go func(i int, user upspin.UserName) {
+			defer wg.Done()
+			u, err := s.key.Lookup(user)
+			results[i] = result{u, err}
+			<-sem
+		}(i, user)
+	}
+	wg.Wait()
+	// Only now touch the caches, which are guarded by the caller.
+	for i, user := range todo {
+		if _, err := s.cacheKey(user, results[i].u, results[i].err); err != nil {
+			log.Error.Printf("watcher: %v: %v", name, err)
+		}
+	}
+}
+
+// cacheKey remembers the result of looking up the user's key, failed or
+// otherwise, and returns the key or the reason it is unusable.
+func (s *Sharer) cacheKey(user upspin.UserName, u *upspin.User, err error) (upspin.PublicKey, error) {
 	if err != nil {
 		s.userKeys[user] = ""
 		return "", err
 	}
-	// Remember the lookup, failed or otherwise.
-	key = u.PublicKey
+	key := u.PublicKey
 	if len(key) == 0 {
 		s.userKeys[user] = ""
 		return "", errors.E(user, "empty public key")
 	}
-
 	s.userKeys[user] = key
 	s.userByHash[sha256.Sum256([]byte(key))] = user
 	return key, nil
@@ -516,6 +833,15 @@ func isWildcardUser(user upspin.UserName) bool {
 	return strings.HasPrefix(string(user), "*@")
 }
 
+// userSet returns the users in set as a userList.
+func userSet(set map[upspin.UserName]bool) userList {
+	u := make(userList, 0, len(set))
+	for user := range set {
+		u = append(u, user)
+	}
+	return u
+}
+
 // userList stores a list of users, and its string representation
 // presents them in sorted order for easy comparison.
 type userList []upspin.UserName
@@ -524,6 +850,16 @@ func (u userList) Len() int           { return len(u) }
 func (u userList) Less(i, j int) bool { return u[i] < u[j] }
 func (u userList) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
 
+// contains reports whether user is in the list.
+func (u userList) contains(user upspin.UserName) bool {
+	for _, v := range u {
+		if v == user {
+			return true
+		}
+	}
+	return false
+}
+
 // String returns a canonically formatted, sorted list of the users.
 func (u userList) String() string {
 	if u == nil {
@@ -15,6 +15,12 @@ var maxBacklog = 64 * 1024 // Tests override this.
 // earlier entries to maintain a buffer size of maxBacklog bytes.
 // Its methods are safe for concurrent use.
 type rollingLog struct {
+	// keepTail, if set, makes a single write larger than maxBacklog
+	// keep only its last maxBacklog bytes, from the first line boundary
+	// among them, so that the most recent output is preserved.
+	// Otherwise such a write is kept whole.
+	keepTail bool
+
 	mu  sync.Mutex
 	buf []byte
 }
@@ -23,7 +29,7 @@ func (l *rollingLog) Write(b []byte) (int, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if len(b) >= maxBacklog {
-		l.buf = append(l.buf[:0], b...)
+		l.buf = append(l.buf[:0], l.tail(b)...)
 		return len(b), nil
 	}
 	if len(l.buf)+len(b) > maxBacklog {
@@ -45,6 +51,22 @@ func (l *rollingLog) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// tail returns the part of b, a write of at least maxBacklog bytes, to keep.
+func (l *rollingLog) tail(b []byte) []byte {
+	if !l.keepTail || len(b) == maxBacklog {
+		return b
+	}
+	i := len(b) - maxBacklog
+	if b[i-1] != '\n' {
+		// Start at the first line feed, so that we don't keep
+		// a partial line, unless the tail is all one line.
+		if j := bytes.IndexByte(b[i:], '\n'); j >= 0 && i+j+1 < len(b) {
+			i += j + 1
+		}
+	}
+	return b[i:]
+}
+
 // Log returns a copy of the log buffer.
 func (l *rollingLog) Log() []byte {
 	l.mu.Lock()
@@ -72,3 +72,31 @@ func validate(b []byte) error {
 	}
 	return nil
 }
+
+func TestRollingLogKeepTail(t *testing.T) {
+	oldMax := maxBacklog
+	defer func() { maxBacklog = oldMax }()
+	maxBacklog = 1024
+	l := rollingLog{keepTail: true}
+	l.Write([]byte("earlier\n"))
+
+	// Write a >maxBacklog string of lines of m's, n's and o's;
+	// only the whole lines within its last maxBacklog bytes remain.
+	mm := strings.Repeat("m", 511)
+	nn := strings.Repeat("n", 511)
+	oo := strings.Repeat("o", 511)
+	l.Write([]byte(fmt.Sprintf("%s\n%s\n%s\n", mm, nn, oo)))
+	want := fmt.Sprintf("%s\n%s\n", nn, oo)
+	if got := string(l.Log()); got != want {
+		t.Fatalf("mismatch after long write\ngot %d bytes: %q\nwant %d bytes: %q",
+			len(got), got, len(want), want)
+	}
+
+	// A single line longer than maxBacklog keeps its last maxBacklog bytes.
+	l.Write([]byte(strings.Repeat("p", 2000) + "\n"))
+	want = strings.Repeat("p", maxBacklog-1) + "\n"
+	if got := string(l.Log()); got != want {
+		t.Fatalf("mismatch after long line\ngot %d bytes: %q\nwant %d bytes: %q",
+			len(got), got, len(want), want)
+	}
+}
@@ -8,10 +8,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
 	"sort"
@@ -19,17 +23,100 @@ import (
 	"sync"
 	"time"
 
+	"exp.upspin.io/internal/cmdconfig"
+	"exp.upspin.io/internal/logformat"
+
 	"upspin.io/flags"
 	"upspin.io/log"
 )
 
 func main() {
 	cmd := flag.String("cmd", "cacheserver,upspinfs,upspin-sharebot", "comma-separated list of `commands` to run")
+	user := flag.String("user", "", "comma-separated list of `command=user` pairs, each naming an OS user (as name[:gid] or uid[:gid]) as whom to run the command; requires privilege, and the user must be able to read a -config file")
+	debug := flag.String("debug", "", "comma-separated list of `command=URL` pairs, each naming the debug HTTP endpoint of a command, which the warden serves under /command/debug/")
+	logFormat := flag.String("logformat", logformat.Text, "`format` of the warden's log lines: text, or json for log aggregators")
+	mountpoint := flag.String("upspinfs-mountpoint", "", "mount `point` for upspinfs; if set, it is passed to upspinfs, and a stale mount left there by a crashed upspinfs is unmounted before upspinfs restarts")
 	flags.Parse(nil, "log", "config", "http")
-	w := NewWarden(strings.Split(*cmd, ","))
+	if !logformat.Valid(*logFormat) {
+		log.Fatalf("-logformat: unknown format %q", *logFormat)
+	}
+	users, err := parseUsers(*user)
+	if err != nil {
+		log.Fatal(err)
+	}
+	debugURLs, err := parseDebug(*debug)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A config given on standard input or in the environment is passed
+	// on to each command; see Options.Config.
+	config, _, err := cmdconfig.Read(flags.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := NewWarden(strings.Split(*cmd, ","), Options{
+		Users:      users,
+		Debug:      debugURLs,
+		Mountpoint: *mountpoint,
+		Config:     config,
+		LogFormat:  *logFormat,
+	})
 	log.Fatal(http.ListenAndServe(flags.HTTPAddr, w))
 }
 
+// parseUsers parses the value of the -user flag into a map from command
+// name to OS user, checking that each user exists.
+func parseUsers(s string) (map[string]string, error) {
+	users, err := parsePairs("user", s)
+	if err != nil {
+		return nil, err
+	}
+	for cmd, user := range users {
+		if err := setUser(&exec.Cmd{}, user); err != nil {
+			return nil, fmt.Errorf("-user: %s: %v", cmd, err)
+		}
+	}
+	return users, nil
+}
+
+// parseDebug parses the value of the -debug flag into a map from command
+// name to the URL of its debug endpoint.
+func parseDebug(s string) (map[string]*url.URL, error) {
+	pairs, err := parsePairs("debug", s)
+	if err != nil {
+		return nil, err
+	}
+	urls := map[string]*url.URL{}
+	for cmd, v := range pairs {
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("-debug: %s: %v", cmd, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("-debug: %s: %q is not an http or https URL", cmd, v)
+		}
+		urls[cmd] = u
+	}
+	return urls, nil
+}
+
+// parsePairs parses the value of the named flag, a comma-separated list
+// of command=value pairs, into a map from command name to value.
+func parsePairs(flagName, s string) (map[string]string, error) {
+	pairs := map[string]string{}
+	if s == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("-%s: %q is not of the form command=%s", flagName, pair, flagName)
+		}
+		pairs[pair[:i]] = pair[i+1:]
+	}
+	return pairs, nil
+}
+
 // restartInterval specifies the time between daemon restarts.
 const restartInterval = 10 * time.Second
 
@@ -39,15 +126,59 @@ type Warden struct {
 	procs map[string]*Process
 }
 
+// Options holds optional settings for the commands run by a Warden.
+type Options struct {
+	// Users maps command names to the OS users as whom to run them.
+	// Commands not present run as the current user.
+	Users map[string]string
+
+	// Debug maps command names to the URLs of their debug HTTP
+	// endpoints, which the warden serves under /command/debug/.
+	Debug map[string]*url.URL
+
+	// Mountpoint, if set, is where upspinfs mounts its file system.
+	Mountpoint string
+
+	// Config, if set, is the Upspin configuration named by a -config
+	// flag of - or env:NAME. The commands that accept those values too,
+	// listed in readsConfigFlag, are given the same flag, with Config on
+	// their standard input for -config=-. Each of the others is given a
+	// private temporary copy of Config as a file, for as long as it runs.
+	Config []byte
+
+	// LogFormat is the format of the warden's own log lines,
+	// logformat.Text (the default) or logformat.JSON.
+	LogFormat string
+}
+
 // NewWarden creates a Warden that runs the given commands.
 // It implements a http.Handler that exports server state and logs.
 // It redirects global Upspin log output to its internal rolling log.
-func NewWarden(cmds []string) *Warden {
+func NewWarden(cmds []string, opts Options) *Warden {
 	w := &Warden{procs: map[string]*Process{}}
 	for _, c := range cmds {
-		w.procs[c] = &Process{name: c}
+		p := &Process{name: c, user: opts.Users[c], config: opts.Config}
+		// Keep the end of any huge write, such as a stack trace.
+		p.log.keepTail, p.stdout.keepTail, p.stderr.keepTail = true, true, true
+		if c == "upspinfs" && opts.Mountpoint != "" {
+			mountpoint := opts.Mountpoint
+			p.args = []string{mountpoint}
+			p.check = func() error { return unmountStale(mountpoint) }
+		}
+		if u := opts.Debug[c]; u != nil {
+			p.debug = http.StripPrefix("/"+c+"/debug", httputil.NewSingleHostReverseProxy(u))
+		}
+		w.procs[c] = p
+	}
+	format := opts.LogFormat
+	if format == "" {
+		format = logformat.Text
+	}
+	out := io.MultiWriter(os.Stderr, &w.log)
+	if err := logformat.Set(format, "upspin-warden", out); err != nil {
+		log.SetOutput(out)
+		log.Error.Print(err)
 	}
-	log.SetOutput(io.MultiWriter(os.Stderr, &w.log))
 	for _, p := range w.procs {
 		go p.Run()
 	}
@@ -62,30 +193,84 @@ func (w *Warden) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(rw, "warden:")
 		fprintLastNLines(rw, w.log.Log(), 10, "\t")
 		// Show processes, their states, and truncated logs.
-		var names []string
-		for n := range w.procs {
-			names = append(names, n)
-		}
-		sort.Strings(names)
-		for _, n := range names {
+		for _, n := range w.names() {
 			p := w.procs[n]
-			fmt.Fprintf(rw, "\n%s: %s\n", n, p.State())
+			fmt.Fprintf(rw, "\n%s: %s\n", n, p.Status())
+			if p.debug != nil {
+				fmt.Fprintf(rw, "\t(debug information at /%s/debug/)\n", n)
+			}
 			fprintLastNLines(rw, p.log.Log(), 10, "\t")
 		}
 	case "warden":
 		// Show complete warden log.
 		rw.Write(w.log.Log())
+	case "health":
+		// Succeed only if every process is running,
+		// for use as a health check by other supervisors.
+		var unhealthy []string
+		for _, n := range w.names() {
+			if p := w.procs[n]; p.State() != Running {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", n, p.Status()))
+			}
+		}
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(unhealthy) > 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(rw, strings.Join(unhealthy, "\n"))
+			return
+		}
+		fmt.Fprintln(rw, "OK")
 	default:
-		// Show log for the given process.
+		// Show log for the given process, either merged
+		// or just one of its output streams, or pass the
+		// request on to the process's debug endpoint.
+		stream := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, stream = name[:i], name[i+1:]
+		}
 		p, ok := w.procs[name]
 		if !ok {
 			http.NotFound(rw, r)
 			return
 		}
-		rw.Write(p.log.Log())
+		if stream == "debug" || strings.HasPrefix(stream, "debug/") {
+			if p.debug == nil {
+				http.NotFound(rw, r)
+				return
+			}
+			p.debug.ServeHTTP(rw, r)
+			return
+		}
+		switch stream {
+		case "":
+			if rs := p.Restarts(); len(rs) > 0 {
+				fmt.Fprintln(rw, "recent restarts:")
+				for _, r := range rs {
+					fmt.Fprintf(rw, "\t%s: %v\n", r.Time.Format(time.RFC3339), r.Err)
+				}
+				fmt.Fprintln(rw)
+			}
+			rw.Write(p.log.Log())
+		case "stdout":
+			rw.Write(p.stdout.Log())
+		case "stderr":
+			rw.Write(p.stderr.Log())
+		default:
+			http.NotFound(rw, r)
+		}
 	}
 }
 
+// names returns the sorted names of the warden's processes.
+func (w *Warden) names() []string {
+	var names []string
+	for n := range w.procs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // fprintLastNLines writes the last n lines of buf to w,
 // adding prefix to the start of each line.
 func fprintLastNLines(w io.Writer, buf []byte, n int, prefix string) {
@@ -120,11 +305,37 @@ const (
 
 // Process manages the execution of a daemon process and captures its logs.
 type Process struct {
-	name string
-	log  rollingLog
+	name   string
+	user   string       // OS user to run as; empty means the warden's own.
+	args   []string     // Arguments following the standard flags.
+	config []byte       // Config not read from a file; nil means none.
+	debug  http.Handler // Proxy for the debug endpoint; nil means none.
+	log    rollingLog   // Standard output and error, merged.
+
+	// check, if set, is called before each start of the process to
+	// verify or repair the conditions it needs. If it fails, the
+	// start is abandoned until the next restart.
+	check func() error
 
-	mu    sync.Mutex
-	state ProcessState
+	stdout, stderr rollingLog
+
+	mu        sync.Mutex
+	state     ProcessState
+	startedAt time.Time // When state last became Running.
+
+	// restarts is a ring buffer of the most recent exits of the
+	// process; nRestarts counts all of them.
+	restarts  [maxRestarts]Restart
+	nRestarts int
+}
+
+// maxRestarts is the number of recent restarts remembered by a Process.
+const maxRestarts = 10
+
+// Restart records an exit of a Process that led to its restart.
+type Restart struct {
+	Time time.Time // When the process exited.
+	Err  error     // The error it exited with.
 }
 
 // State reports the state of the process.
@@ -134,13 +345,57 @@ func (p *Process) State() ProcessState {
 	return p.state
 }
 
+// StartedAt reports when the process last entered the Running state,
+// or the zero time if it never has.
+func (p *Process) StartedAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startedAt
+}
+
+// Status describes the state of the process and, if it is running,
+// for how long it has been up.
+func (p *Process) Status() string {
+	p.mu.Lock()
+	state, startedAt := p.state, p.startedAt
+	p.mu.Unlock()
+	if state != Running {
+		return state.String()
+	}
+	up := time.Since(startedAt).Round(time.Second)
+	return fmt.Sprintf("%s, up for %v (since %s)", state, up, startedAt.Format(time.RFC3339))
+}
+
+// Restarts reports the most recent restarts of the process, oldest first.
+func (p *Process) Restarts() []Restart {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.nRestarts
+	if n > maxRestarts {
+		n = maxRestarts
+	}
+	rs := make([]Restart, n)
+	for i := range rs {
+		rs[i] = p.restarts[(p.nRestarts-n+i)%maxRestarts]
+	}
+	return rs
+}
+
+func (p *Process) addRestart(err error) {
+	p.mu.Lock()
+	p.restarts[p.nRestarts%maxRestarts] = Restart{Time: time.Now(), Err: err}
+	p.nRestarts++
+	p.mu.Unlock()
+}
+
 // Run executes the process in a loop, restarting it after restartInterval
 // since its last start.
 func (p *Process) Run() {
 	for {
 		started := time.Now()
 		err := p.exec()
-		log.Error.Printf("%v: %v", p.name, err)
+		logformat.Event("error", fmt.Sprintf("%v: %v", p.name, err), "process", p.name, "error", err)
+		p.addRestart(err)
 		if d := time.Since(started); d < restartInterval {
 			i := restartInterval - d
 			log.Debug.Printf("%v: waiting %v before restarting", p.name, i)
@@ -152,13 +407,43 @@ func (p *Process) Run() {
 // Exec starts the process and waits for it to return,
 // updating the process's state field as necessary.
 func (p *Process) exec() error {
-	cmd := exec.Command(p.name,
+	if p.check != nil {
+		if err := p.check(); err != nil {
+			p.setState(Error)
+			return err
+		}
+	}
+	cmd := exec.Command(p.name)
+	cmd.Stdout = io.MultiWriter(&p.log, &p.stdout)
+	cmd.Stderr = io.MultiWriter(&p.log, &p.stderr)
+	if p.user != "" {
+		if err := setUser(cmd, p.user); err != nil {
+			return err
+		}
+	}
+	configFlag := flags.Config
+	if p.config != nil {
+		if !readsConfigFlag[p.name] {
+			name, err := writeConfig(cmd, p.config)
+			if err != nil {
+				p.setState(Error)
+				return err
+			}
+			defer os.Remove(name)
+			configFlag = name
+		} else if flags.Config == cmdconfig.Stdin {
+			cmd.Stdin = bytes.NewReader(p.config)
+		}
+	}
+	cmd.Args = append(append(cmd.Args,
 		"-log="+flags.Log.String(),
-		"-config="+flags.Config)
-	cmd.Stdout = &p.log
-	cmd.Stderr = &p.log
+		"-config="+configFlag,
+	), p.args...)
 	p.setState(Starting)
 	if err := cmd.Start(); err != nil {
+		if p.user != "" && errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("cannot run as user %q; the warden lacks the privilege to change user: %v", p.user, err)
+		}
 		return err
 	}
 	p.setState(Running)
@@ -167,9 +452,39 @@ func (p *Process) exec() error {
 	return err
 }
 
+// readsConfigFlag holds the commands that load their config with the
+// cmdconfig package, and so accept any -config value the warden does.
+var readsConfigFlag = map[string]bool{
+	"upspin-sharebot": true,
+}
+
+// writeConfig writes config to a new temporary file, readable only by the
+// user as whom cmd runs, and returns its name. The caller removes the file.
+func writeConfig(cmd *exec.Cmd, config []byte) (string, error) {
+	f, err := ioutil.TempFile("", "upspin-warden-config")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(config)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = chownToUser(f.Name(), cmd)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing config file: %v", err)
+	}
+	return f.Name(), nil
+}
+
 func (p *Process) setState(s ProcessState) {
 	p.mu.Lock()
 	p.state = s
+	if s == Running {
+		p.startedAt = time.Now()
+	}
 	p.mu.Unlock()
-	log.Debug.Printf("%s: %s", p.name, s)
+	logformat.Event("debug", fmt.Sprintf("%s: %s", p.name, s), "process", p.name, "state", s.String())
 }
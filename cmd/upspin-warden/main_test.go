@@ -0,0 +1,64 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	w := &Warden{procs: map[string]*Process{
+		"cacheserver": {name: "cacheserver", state: Running},
+		"upspinfs":    {name: "upspinfs", state: Error},
+	}}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		return rec
+	}
+
+	rec := get()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with a failed process = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "upspinfs") || strings.Contains(body, "cacheserver") {
+		t.Errorf("body = %q, want only the failed upspinfs", body)
+	}
+
+	w.procs["upspinfs"].setState(Running)
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Errorf("status with all processes running = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	const config = "username: user@example.com\n"
+	name, err := writeConfig(&exec.Cmd{}, []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != config {
+		t.Errorf("config file holds %q, want %q", b, config)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("config file mode is %v, want private", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// unmountStale does nothing, as there is no FUSE on this system.
+func unmountStale(mountpoint string) error {
+	return nil
+}
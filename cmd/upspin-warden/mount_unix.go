@@ -0,0 +1,45 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"upspin.io/log"
+)
+
+// unmountStale checks whether mountpoint is the remains of a FUSE file
+// system whose server has died, and if so unmounts it so that a new
+// server may mount there.
+func unmountStale(mountpoint string) error {
+	_, err := os.Stat(mountpoint)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	// A dead FUSE server leaves a mount whose every access fails.
+	// Other errors are for upspinfs itself to report.
+	if !errors.Is(err, syscall.ENOTCONN) && !errors.Is(err, syscall.ENXIO) && !errors.Is(err, syscall.EIO) {
+		return nil
+	}
+	log.Info.Printf("upspinfs: unmounting stale mount point %s: %v", mountpoint, err)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("fusermount", "-u", "-z", mountpoint)
+	} else {
+		cmd = exec.Command("umount", "-f", mountpoint)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unmounting stale mount point %s: %v: %s", mountpoint, err, out)
+	}
+	return nil
+}
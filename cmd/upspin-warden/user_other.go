@@ -0,0 +1,24 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// setUser reports that commands cannot be run as another user on this system.
+func setUser(cmd *exec.Cmd, name string) error {
+	return fmt.Errorf("cannot run as user %q: not supported on %s", name, runtime.GOOS)
+}
+
+// chownToUser does nothing, as setUser never sets a user on this system.
+func chownToUser(name string, cmd *exec.Cmd) error {
+	return nil
+}
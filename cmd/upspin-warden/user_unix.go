@@ -0,0 +1,69 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setUser arranges for cmd to run as the given OS user, specified as
+// name[:gid] or uid[:gid]. If no group is given, the user's primary group
+// is used.
+func setUser(cmd *exec.Cmd, name string) error {
+	uid, gid := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		uid, gid = name[:i], name[i+1:]
+	}
+	if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+		u, err := user.Lookup(uid)
+		if err != nil {
+			return err
+		}
+		uid = u.Uid
+		if gid == "" {
+			gid = u.Gid
+		}
+	} else if gid == "" {
+		u, err := user.LookupId(uid)
+		if err != nil {
+			return err
+		}
+		gid = u.Gid
+	}
+	uidN, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gidN, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uint32(uidN),
+		Gid: uint32(gidN),
+	}
+	return nil
+}
+
+// chownToUser gives the named file to the user and group as whom cmd runs,
+// if setUser has set them.
+func chownToUser(name string, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return nil
+	}
+	c := cmd.SysProcAttr.Credential
+	return os.Chown(name, int(c.Uid), int(c.Gid))
+}
@@ -0,0 +1,18 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeSpace is not implemented on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("cannot measure free disk space on %s", runtime.GOOS)
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var lockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var errLocked = errors.New("locked")
+
+// lockFile takes an exclusive lock on f without waiting, returning errLocked
+// if another process holds it. The lock lasts until f is closed. It covers a
+// byte far past the end of the file, because Windows locks are mandatory and
+// others must still be able to read the pid written there.
+func lockFile(f *os.File) error {
+	ol := syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := lockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
@@ -7,32 +7,48 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"upspin.io/client"
 	"upspin.io/cmd/cacheserver/cacheutil"
 	"upspin.io/config"
+	"upspin.io/errors"
 	"upspin.io/flags"
 	"upspin.io/transports"
 	"upspin.io/upspin"
+	"upspin.io/user"
 	"upspin.io/version"
 )
 
 var lastUpsync int64 // Unix time when an upsync was last completed
 
+// stats counts the file transfers of the current upsync pass.
+var stats struct {
+	pulled, pushed, failed   int
+	pulledBytes, pushedBytes int64
+}
+
 const help = `Upsync keeps a local disk copy in sync with a master version in
 Upspin. It is a weak substitute for upspinfs.
 
 To start, create a local directory whose path ends in a string that looks like
 an existing upspin directory, such as ~/u/alice@example.com. Cd there and execute
-upsync.  Make local edits to the downloaded files or create new files, and then
+upsync, or run upsync -dir $HOME/u/alice@example.com from anywhere, such as cron.
+Make local edits to the downloaded files or create new files, and then
 upsync to upload your changes to the Upspin master. To discard your local changes,
 just remove the edited local files and upsync. (Executing both local rm and
 upspin rm are required to remove content permanently.)
@@ -40,6 +56,31 @@ upspin rm are required to remove content permanently.)
 Upsync prints which files it is uploading or downloading and declines to download
 files larger than 50MB. It promises never to write outside the starting directory
 and subdirectories and, as an initial way to enforce that, declines all symlinks.
+Its own state lives in files named .upsync.* in the starting directory, which
+are never synced. While running it holds a lock on .upsync.lock, so that
+overlapping runs (from cron, say) cannot race each other; the system drops the
+lock if upsync dies. Files you lack permission to read are downloaded as empty
+placeholders, listed in .upsync.placeholders; these are never uploaded, and are
+replaced by the real content once you are granted access. Pulled files are
+written in full before they replace the local copy. Pushed files are listed in
+.upsync.manifest until a run completes cleanly, so that after an interruption
+between uploading a file and setting its Upspin mtime, a rerun does not pull
+back what it just pushed, unless someone has changed it in Upspin since. The
+files in sync at the end of a clean run are listed in .upsync.synced, so that
+-rename can tell a file removed locally from one newly created in Upspin.
+
+With -http=localhost:port, upsync keeps running after the first pass, even if
+it failed, and syncs again each time a script POSTs to
+http://localhost:port/sync, replying with the number of files pulled, pushed,
+and failed as JSON.
+
+With -min-free=size, upsync stops, reporting what it synced so far, before a
+pull would leave less than size free on the local disk. Upsync again once you
+have freed some space to carry on where it stopped.
+
+Upsync exits with status 0 on success; 3 if it could not start because of a bad
+config or working directory or another upsync running; 4 if the tree walk failed
+or no file could be transferred; and 5 if some files transferred but others failed.
 
 There are no clever merge heuristics;  copying back and forth proceeds by a trivial
 "newest wins" rule.  This requires some discipline in remembering to upsync after
@@ -62,7 +103,7 @@ assist a friend with file sharing or backup on Windows 10.  Here is a checklist:
 4. open a powershell window
 5. install go and git, if not already there
 6. go get -u upspin.io/cmd/...
-7. fetch upsync.go; go install
+7. fetch upsync.go, freespace_*.go and lock_*.go; go install
    Go files must be transferred as UTF8, else expect a NUL compile warning.
 8. mkdir \Users\alice\u\alice@example.com
 9. upsync
@@ -71,7 +112,74 @@ assist a friend with file sharing or backup on Windows 10.  Here is a checklist:
 
 const cmdName = "upsync"
 
-var upsyncFlag = flag.String("upsync", upspinDir("upsync"), "file whose mtime is last upsync")
+// Upsync keeps its own state in files in the starting directory whose names
+// begin with privatePrefix. They are never synced.
+const (
+	privatePrefix = ".upsync."
+
+	// lockName marks an upsync in progress.
+	lockName = privatePrefix + "lock"
+
+	// placeholdersName lists the local placeholders created for
+	// files we had no permission to read, one pathname per line.
+	placeholdersName = privatePrefix + "placeholders"
+
+	// syncedName lists the files present on both sides at the end
+	// of the last clean upsync, one pathname per line.
+	syncedName = privatePrefix + "synced"
+
+	// manifestName lists the files pushed by an upsync that has not
+	// yet completed cleanly, one per line as "size mtime sequence pathname".
+	manifestName = privatePrefix + "manifest"
+
+	// pullPrefix begins the names of the temporary files in which
+	// pulled content is written before it is renamed into place.
+	pullPrefix = privatePrefix + "pull"
+)
+
+// placeholders holds the pathnames of the local placeholder files.
+// A placeholder must never be pushed, lest it replace content we cannot read.
+var placeholders = make(map[string]bool)
+
+// lastSynced holds the files recorded in syncedName by the last clean sync
+// pass, and synced collects those of the current pass. A file in lastSynced
+// that is missing on one side was removed there, not newly created on the
+// other.
+var (
+	lastSynced = make(map[string]bool)
+	synced     = make(map[string]bool)
+)
+
+// sizeTime is the size and modification time of a file.
+type sizeTime struct{ size, time int64 }
+
+// pushRecord is the local size and mtime of a pushed file, and the
+// sequence number Upspin gave the entry it created.
+type pushRecord struct {
+	sizeTime
+	seq int64
+}
+
+// manifest holds the files pushed by the current or an interrupted upsync.
+// While a sync pass runs, manifestFile is open to record more.
+var (
+	manifest     = make(map[string]pushRecord)
+	manifestFile *os.File
+)
+
+var (
+	upsyncFlag  = flag.String("upsync", upspinDir("upsync"), "file whose mtime is last upsync")
+	timeoutFlag = flag.Duration("timeout", 0, "abandon any single file transfer taking longer than `duration` (0 means no limit)")
+	renameFlag  = flag.Bool("rename", false, "treat a new local file with the size and mtime of a vanished one as a rename, and rename it in Upspin rather than upload it again")
+	pruneFlag   = flag.Bool("prune-empty", false, "after syncing, remove directories below the starting directory that held files at the last clean sync and are now empty both locally and in Upspin")
+	cacheFlag   = flag.String("cache", "", "keep a copy of downloaded content in `directory` and reuse it instead of downloading identical content again")
+	httpFlag    = flag.String("http", "", "after syncing, keep running and serve /sync on this loopback `address` to sync again on demand")
+	dirFlag     = flag.String("dir", "", "sync the local `directory` instead of the current one")
+	minFreeFlag = flag.String("min-free", "", "stop before a pull would leave less than `size` (such as 500MB or 2GB) free on the local disk")
+)
+
+// minFree is the parsed value of -min-free, in bytes; 0 means no limit.
+var minFree int64
 
 func usage() {
 	fmt.Fprintln(os.Stderr, help)
@@ -90,72 +198,305 @@ func main() {
 	}
 	if flag.NArg() > 0 {
 		usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
 	err := do()
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		code := exitError
+		if e, ok := err.(*syncError); ok {
+			code = e.code
+		}
+		os.Exit(code)
 	}
 }
 
+// Exit codes, so that wrapping scripts can tell failures apart.
+const (
+	exitOK       = 0
+	exitError    = 1 // Any other failure.
+	exitUsage    = 2 // Bad command line.
+	exitConfig   = 3 // Bad config or working directory, or another upsync is running; nothing synced.
+	exitTransfer = 4 // The tree walk failed, or every attempted file transfer failed.
+	exitPartial  = 5 // Some file transfers succeeded and some failed.
+)
+
+// syncError is an error together with the exit code it implies.
+type syncError struct {
+	code int
+	err  error
+}
+
+func (e *syncError) Error() string { return e.err.Error() }
+
 func do() error {
+	upc, wd, getwd, unlock, err := prepare()
+	if err != nil {
+		return &syncError{exitConfig, err}
+	}
+	defer unlock()
+
+	// Start copying.
+	err = syncPass(upc, wd, getwd)
+	if *httpFlag == "" {
+		return err
+	}
+	if err != nil {
+		// Serve anyway; a later pass may get further.
+		log.Printf("first pass: %v", err)
+	}
+	return serve(upc, wd, getwd)
+}
+
+// prepare readies an upsync of the current directory, returning the
+// Upspin client, the Upspin directory wd that corresponds to the current
+// directory getwd, and a function that releases the upsync lock.
+func prepare() (upc upspin.Client, wd, getwd string, unlock func(), err error) {
+	if *httpFlag != "" {
+		err = checkLoopback(*httpFlag)
+		if err != nil {
+			err = fmt.Errorf("-http: %v", err)
+			return
+		}
+	}
+
 	// Setup Upspin client.
 	cfg, err := config.FromFile(flags.Config)
 	if err != nil {
-		return err
+		return
 	}
 	transports.Init(cfg)
 	cacheutil.Start(cfg)
-	upc := client.New(cfg)
+	upc = client.New(cfg)
 
-	// Guess at previous upsync time.
-	getwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	lastUpsyncFi, err := os.Stat(*upsyncFlag)
-	if os.IsNotExist(err) { // first time
-		err = ioutil.WriteFile(*upsyncFlag, []byte(getwd), 0644)
+	// Everything below works relative to the starting directory.
+	if *dirFlag != "" {
+		// Paths given by other flags are relative to where upsync was run.
+		for _, f := range []*string{upsyncFlag, cacheFlag} {
+			if *f == "" {
+				continue
+			}
+			*f, err = filepath.Abs(*f)
+			if err != nil {
+				return
+			}
+		}
+		err = os.Chdir(*dirFlag)
 		if err != nil {
-			return err
+			err = fmt.Errorf("-dir: %v", err)
+			return
 		}
-	} else if err != nil { // stat failed; very unusual
-		return err
-	} else { // normal case
-		lastUpsync = lastUpsyncFi.ModTime().Unix()
 	}
-	if lastUpsyncFi != nil {
-		log.Printf("lastUpsync %v", lastUpsyncFi.ModTime())
+
+	getwd, err = os.Getwd()
+	if err != nil {
+		return
 	}
 
 	// Find first component of current directory that looks like email address,
 	// then make wd == upspin working directory.
-	wd := getwd
+	wd = getwd
 	i := strings.IndexByte(wd, '@')
 	if i < 0 {
-		return fmt.Errorf("couldn't find upspin user name in working directory %s", getwd)
+		err = fmt.Errorf("couldn't find upspin user name in working directory %s", getwd)
+		return
 	}
 	i = strings.LastIndexAny(wd[:i], "\\/")
 	if i < 0 {
-		return fmt.Errorf("unable to parse working directory %s", getwd)
+		err = fmt.Errorf("unable to parse working directory %s", getwd)
+		return
 	}
 	slash := wd[i : i+1]
 	wd = wd[i+1:]
 	if slash != "/" {
 		wd = strings.ReplaceAll(wd, slash, "/")
 	}
+	userName := wd
+	if j := strings.IndexByte(userName, '/'); j >= 0 {
+		userName = userName[:j]
+	}
+	if _, _, _, perr := user.Parse(upspin.UserName(userName)); perr != nil {
+		err = fmt.Errorf("working directory %s does not correspond to an Upspin directory: %v", getwd, perr)
+		return
+	}
 
-	// Start copying.
+	// Only now that this is known to be an Upspin tree, claim it.
+	unlock, err = lock()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+	err = loadPlaceholders()
+	if err != nil {
+		return
+	}
+	err = loadSynced()
+	if err != nil {
+		return
+	}
+	err = loadManifest()
+	if err != nil {
+		return
+	}
+	if *cacheFlag != "" {
+		err = os.MkdirAll(*cacheFlag, 0700)
+		if err != nil {
+			return
+		}
+	}
+	if *minFreeFlag != "" {
+		minFree, err = parseSize(*minFreeFlag)
+		if err != nil {
+			err = fmt.Errorf("-min-free: %v", err)
+			return
+		}
+		// Fail now if free space cannot be measured here.
+		_, err = freeSpace(".")
+		if err != nil {
+			err = fmt.Errorf("-min-free: %v", err)
+			return
+		}
+	}
+
+	// Guess at previous upsync time.
+	lastUpsyncFi, err := os.Stat(*upsyncFlag)
+	if os.IsNotExist(err) { // first time
+		err = ioutil.WriteFile(*upsyncFlag, []byte(getwd), 0644)
+		if err != nil {
+			return
+		}
+	} else if err != nil { // stat failed; very unusual
+		return
+	} else { // normal case
+		lastUpsync = lastUpsyncFi.ModTime().Unix()
+	}
+	if lastUpsyncFi != nil {
+		log.Printf("lastUpsync %v", lastUpsyncFi.ModTime())
+	}
+	return
+}
+
+// syncPass upsyncs the whole tree and, if every transfer succeeded,
+// records the time for the "skipping old" heuristic of the next pass.
+func syncPass(upc upspin.Client, wd, getwd string) error {
+	stats.pulled, stats.pushed, stats.failed = 0, 0, 0
+	stats.pulledBytes, stats.pushedBytes = 0, 0
+	synced = make(map[string]bool)
+	err := openManifest()
+	if err != nil {
+		return &syncError{exitConfig, err}
+	}
+	defer closeManifest()
 	err = upsync(upc, wd, "")
+	if perr := savePlaceholders(); err == nil {
+		err = perr
+	}
+	log.Printf("pulled %d files / %s, pushed %d files / %s, %d errors",
+		stats.pulled, formatSize(stats.pulledBytes), stats.pushed, formatSize(stats.pushedBytes), stats.failed)
+	if e, ok := err.(*lowDiskError); ok {
+		code := exitPartial
+		if stats.pulled+stats.pushed == 0 {
+			code = exitTransfer
+		}
+		return &syncError{code, fmt.Errorf("%v; stopped after pulling %d and pushing %d files (%d failed); free some space and upsync again",
+			e, stats.pulled, stats.pushed, stats.failed)}
+	}
+	if err != nil {
+		return &syncError{exitTransfer, err}
+	}
+	if stats.failed > 0 {
+		// Don't record the time, or the failed pushes would be skipped as old next time.
+		code := exitPartial
+		if stats.pulled+stats.pushed == 0 {
+			code = exitTransfer
+		}
+		return &syncError{code, fmt.Errorf("%d file transfers failed", stats.failed)}
+	}
+	if *pruneFlag {
+		_, err = prune(upc, wd, "", heldDirs())
+		if err != nil {
+			return &syncError{exitPartial, err}
+		}
+	}
+	err = removeManifest()
+	if err != nil {
+		return err
+	}
+	lastSynced = synced
+	err = saveSynced()
 	if err != nil {
 		return err
 	}
 
 	// Save time of this upsync for next upsync "skipping old" heuristic.
 	err = ioutil.WriteFile(*upsyncFlag, []byte(getwd), 0644)
-	// We're more or less successful even if we can't record the time.  But warn.
-	return err
+	if err != nil {
+		// We're more or less successful even if we can't record the time.  But warn.
+		return err
+	}
+	fi, err := os.Stat(*upsyncFlag)
+	if err != nil {
+		return err
+	}
+	lastUpsync = fi.ModTime().Unix()
+	return nil
+}
+
+// checkLoopback returns an error unless addr is a host:port address on the
+// loopback interface, so that no one else can trigger a sync.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// serve listens on the loopback address *httpFlag, checked by prepare, and
+// runs a sync pass for each POST to /sync, replying with the pass's transfer
+// counts as JSON.
+func serve(upc upspin.Client, wd, getwd string) error {
+	var mu sync.Mutex // Serializes sync passes.
+	http.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "sync requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		err := syncPass(upc, wd, getwd)
+		result := struct {
+			Pulled      int    `json:"pulled"`
+			Pushed      int    `json:"pushed"`
+			Failed      int    `json:"failed"`
+			PulledBytes int64  `json:"pulled_bytes"`
+			PushedBytes int64  `json:"pushed_bytes"`
+			Error       string `json:"error,omitempty"`
+		}{
+			Pulled:      stats.pulled,
+			Pushed:      stats.pushed,
+			Failed:      stats.failed,
+			PulledBytes: stats.pulledBytes,
+			PushedBytes: stats.pushedBytes,
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			log.Print(err)
+			result.Error = err.Error()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	log.Printf("serving http://%s/sync", *httpFlag)
+	return http.ListenAndServe(*httpFlag, nil)
 }
 
 // upsync walks the local and remote trees rooted at subdir to update each file to newer versions.
@@ -165,14 +506,70 @@ func do() error {
 func upsync(upc upspin.Client, wd, subdir string) error {
 
 	// udir and ldir are sorted lists of remote and local files in subdir.
-	udir, err := upc.Glob(wd + "/" + subdir + "*")
+	udir, ldir, err := list(upc, wd, subdir)
 	if err != nil {
 		return err
 	}
-	ldir, err := ioutil.ReadDir(subdir + ".")
+	if *renameFlag {
+		renamed, err := renames(upc, wd, subdir, udir, ldir)
+		if err != nil {
+			return err
+		}
+		if renamed {
+			udir, ldir, err = list(upc, wd, subdir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	actions, err := plan(wd, subdir, udir, ldir, placeholders)
 	if err != nil {
 		return err
 	}
+	for _, a := range actions {
+		err = apply(upc, wd, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An op is the kind of an action.
+type op int
+
+const (
+	opInSync             op = iota // Same file on both sides; nothing to do.
+	opPull                         // Copy remote file to local disk.
+	opPush                         // Copy local file to Upspin.
+	opSkipLink                     // Ignore remote link.
+	opSkipBig                      // Ignore remote file too big to download.
+	opMkdirLocal                   // Create local directory, then upsync it.
+	opMkdirRemote                  // Create Upspin directory, then upsync it.
+	opDescend                      // Upsync directory present on both sides.
+	opPlaceholder                  // Create local placeholder for unreadable remote file.
+	opKeepPlaceholder              // Leave placeholder for still unreadable remote file.
+	opReplacePlaceholder           // Replace placeholder by now readable remote file.
+	opRemovePlaceholder            // Remove placeholder for vanished remote file.
+)
+
+// An action is a step planned by plan to bring one name into sync.
+type action struct {
+	op       op
+	pathname string           // Relative to the starting directory.
+	entry    *upspin.DirEntry // The remote entry, if any.
+	ltime    int64            // The local modification time, if any.
+}
+
+// plan compares udir and ldir, the sorted remote and local listings of
+// subdir, and returns in order the actions that will copy newer to older
+// or missing. Names recorded in placeholders are local placeholders for
+// unreadable remote files. Plan neither reads nor writes either tree.
+// It fails if ldir holds a symlink or if a name is a directory on one
+// side but not the other.
+func plan(wd, subdir string, udir []*upspin.DirEntry, ldir []os.FileInfo, placeholders map[string]bool) ([]action, error) {
+	var actions []action
 
 	// Advance through the two lists, comparing at each iteration udir[uj] and ldir[lj].
 	uj := 0
@@ -180,7 +577,7 @@ func upsync(upc upspin.Client, wd, subdir string) error {
 	for {
 		cmp := 0 // -1,0,1 as udir[uj] sorts before,same,after ldir[lj]
 		if lj < len(ldir) && ldir[lj].Mode()&os.ModeSymlink != 0 {
-			return fmt.Errorf("local symlinks are not allowed: %s", ldir[lj].Name())
+			return nil, fmt.Errorf("local symlinks are not allowed: %s", ldir[lj].Name())
 		}
 		if uj >= len(udir) {
 			if lj >= len(ldir) {
@@ -193,140 +590,784 @@ func upsync(upc upspin.Client, wd, subdir string) error {
 			cmp = strings.Compare(string(udir[uj].SignedName)[len(wd)+1:], subdir+ldir[lj].Name())
 		}
 
-		// Copy newer to older/missing.
 		switch cmp {
 		case -1:
-			pathname := string(udir[uj].SignedName)[len(wd)+1:]
+			a := action{
+				op:       opPull,
+				pathname: string(udir[uj].SignedName)[len(wd)+1:],
+				entry:    udir[uj],
+			}
 			switch {
 			case udir[uj].Attr&upspin.AttrLink != 0:
-				fmt.Println("ignoring upspin symlink", pathname)
+				a.op = opSkipLink
 			case udir[uj].Attr&upspin.AttrDirectory != 0:
-				err = os.Mkdir(pathname, 0700)
-				if err != nil {
-					return err
-				}
-				err = upsync(upc, wd, pathname+"/")
-				if err != nil {
-					return err
-				}
+				a.op = opMkdirLocal
 			case udir[uj].Attr&upspin.AttrIncomplete != 0:
-				fmt.Println("permission problem; creating placeholder ", pathname)
-				empty := make([]byte, 0)
-				err = ioutil.WriteFile(pathname, empty, 0)
-				if err != nil {
-					return err
-				}
+				a.op = opPlaceholder
 			case len(udir[uj].Blocks) > 50:
-				fmt.Println("skipping big", pathname)
-			default:
-				utime := int64(udir[uj].Time)
-				err = pull(upc, wd, pathname, utime)
-				if err != nil {
-					return err
-				}
+				a.op = opSkipBig
 			}
+			actions = append(actions, a)
 			uj++
 		case 0:
-			pathname := subdir + ldir[lj].Name()
+			a := action{
+				op:       opInSync,
+				pathname: subdir + ldir[lj].Name(),
+				entry:    udir[uj],
+				ltime:    ldir[lj].ModTime().Unix(),
+			}
 			uIsDir := udir[uj].Attr&upspin.AttrDirectory != 0
 			lIsDir := ldir[lj].IsDir()
 			if uIsDir != lIsDir {
-				return fmt.Errorf("same name, different Directory attribute! %s", pathname)
+				return nil, fmt.Errorf("same name, different Directory attribute! %s", a.pathname)
 			}
-			if uIsDir {
-				err = upsync(upc, wd, pathname+"/")
-				if err != nil {
-					return err
-				}
-			} else {
-				utime := int64(udir[uj].Time)
-				ltime := ldir[lj].ModTime().Unix()
-				if utime > ltime {
-					err = pull(upc, wd, pathname, utime)
-					if err != nil {
-						return err
-					}
-				} else if utime < ltime {
-					err = push(upc, wd, pathname, ltime)
-					if err != nil {
-						return err
-					}
-				} else {
-					// Assume already in sync.
-					// TODO(ehg) Compare sizes as sanity check?
-				}
+			utime := int64(udir[uj].Time)
+			switch {
+			case uIsDir:
+				a.op = opDescend
+			case udir[uj].Attr&upspin.AttrIncomplete != 0 && (placeholders[a.pathname] || ldir[lj].Size() == 0):
+				// Still unreadable. An empty local file is taken to be
+				// a placeholder made before placeholders were recorded.
+				a.op = opKeepPlaceholder
+			case placeholders[a.pathname]:
+				// We have been granted access since creating the placeholder.
+				a.op = opReplacePlaceholder
+			case utime > a.ltime:
+				a.op = opPull
+			case utime < a.ltime:
+				a.op = opPush
+			default:
+				// Assume already in sync.
+				// TODO(ehg) Compare sizes as sanity check?
 			}
+			actions = append(actions, a)
 			uj++
 			lj++
 		case 1:
-			pathname := subdir + ldir[lj].Name()
+			a := action{
+				op:       opPush,
+				pathname: subdir + ldir[lj].Name(),
+				ltime:    ldir[lj].ModTime().Unix(),
+			}
 			if ldir[lj].IsDir() {
-				fmt.Println("upspin mkdir", wd+"/"+pathname)
-				_, err = upc.MakeDirectory(upspin.PathName(wd + "/" + pathname))
-				if err != nil {
-					return err
-				}
-				err = upsync(upc, wd, pathname+"/")
-				if err != nil {
-					return err
-				}
-			} else {
-				ltime := ldir[lj].ModTime().Unix()
-				err = push(upc, wd, pathname, ltime)
-				if err != nil {
-					return err
-				}
+				a.op = opMkdirRemote
+			} else if placeholders[a.pathname] {
+				// The unreadable file is gone from Upspin; so is its placeholder.
+				a.op = opRemovePlaceholder
 			}
+			actions = append(actions, a)
 			lj++
 		}
 	}
+	return actions, nil
+}
+
+// apply carries out the action a, recursively upsyncing any directory.
+// Failed pulls and pushes are recorded by transfer and do not stop the upsync.
+func apply(upc upspin.Client, wd string, a action) error {
+	var err error
+	switch a.op {
+	case opInSync:
+		synced[a.pathname] = true
+	case opPull:
+		if pushed(a.pathname, a.entry) {
+			fmt.Println("already pushed", a.pathname)
+			break
+		}
+		err = pullAndCount(upc, wd, a)
+	case opPush:
+		e, perr := push(upc, wd, a.pathname, a.ltime)
+		if e != nil {
+			// Even if setting the mtime failed, the content is in Upspin.
+			record(a.pathname, e.Sequence)
+		}
+		transfer("push", a.pathname, perr)
+	case opSkipLink:
+		fmt.Println("ignoring upspin symlink", a.pathname)
+	case opSkipBig:
+		fmt.Println("skipping big", a.pathname)
+	case opMkdirLocal:
+		err = os.Mkdir(a.pathname, 0700)
+		if err != nil {
+			return err
+		}
+		err = upsync(upc, wd, a.pathname+"/")
+	case opMkdirRemote:
+		fmt.Println("upspin mkdir", wd+"/"+a.pathname)
+		_, err = upc.MakeDirectory(upspin.PathName(wd + "/" + a.pathname))
+		if err != nil {
+			return err
+		}
+		err = upsync(upc, wd, a.pathname+"/")
+	case opDescend:
+		err = upsync(upc, wd, a.pathname+"/")
+	case opPlaceholder:
+		fmt.Println("permission problem; creating placeholder ", a.pathname)
+		empty := make([]byte, 0)
+		err = ioutil.WriteFile(a.pathname, empty, 0)
+		if err != nil {
+			return err
+		}
+		placeholders[a.pathname] = true
+	case opKeepPlaceholder:
+		placeholders[a.pathname] = true
+	case opReplacePlaceholder:
+		fmt.Println("replacing placeholder", a.pathname)
+		err = os.Remove(a.pathname)
+		if err != nil {
+			return err
+		}
+		delete(placeholders, a.pathname)
+		err = pullAndCount(upc, wd, a)
+	case opRemovePlaceholder:
+		fmt.Println("removing placeholder", a.pathname)
+		err = os.Remove(a.pathname)
+		if err != nil {
+			return err
+		}
+		delete(placeholders, a.pathname)
+	default:
+		err = fmt.Errorf("unknown op %d for %s", a.op, a.pathname)
+	}
+	return err
+}
+
+// prune removes, bottom up, the directories below subdir that are in held and
+// are empty both locally and in Upspin, and reports whether subdir itself is
+// now empty. It never removes subdir itself, so the starting directory always
+// remains, nor a directory outside held, so new or deliberately empty
+// directories remain too.
+func prune(upc upspin.Client, wd, subdir string, held map[string]bool) (empty bool, err error) {
+	ldir, err := ioutil.ReadDir(subdir + ".")
+	if err != nil {
+		return false, err
+	}
+	n := len(ldir)
+	for _, fi := range ldir {
+		if !fi.IsDir() {
+			continue
+		}
+		pathname := subdir + fi.Name()
+		empty, err := prune(upc, wd, pathname+"/", held)
+		if err != nil {
+			return false, err
+		}
+		if !empty || !held[pathname] {
+			continue
+		}
+		upath := upspin.PathName(wd + "/" + pathname)
+		udir, err := upc.Glob(string(upath) + "/*")
+		if err != nil {
+			return false, err
+		}
+		if len(udir) > 0 {
+			continue
+		}
+		fmt.Println("prune", pathname)
+		err = upc.Delete(upath)
+		if err != nil && !errors.Is(errors.NotExist, err) {
+			return false, err
+		}
+		err = os.Remove(pathname)
+		if err != nil {
+			return false, err
+		}
+		n--
+	}
+	return n == 0, nil
+}
+
+// heldDirs returns the directories that held files at the end of the last
+// clean sync pass, as recorded in lastSynced.
+func heldDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	for name := range lastSynced {
+		for i := strings.LastIndexByte(name, '/'); i >= 0; i = strings.LastIndexByte(name, '/') {
+			name = name[:i]
+			if dirs[name] {
+				break // So are its parents.
+			}
+			dirs[name] = true
+		}
+	}
+	return dirs
+}
+
+// list returns the sorted remote and local listings of subdir.
+func list(upc upspin.Client, wd, subdir string) ([]*upspin.DirEntry, []os.FileInfo, error) {
+	udir, err := upc.Glob(wd + "/" + subdir + "*")
+	if err != nil {
+		return nil, nil, err
+	}
+	ldir, err := ioutil.ReadDir(subdir + ".")
+	if err != nil {
+		return nil, nil, err
+	}
+	if subdir == "" {
+		udir, ldir = withoutPrivate(wd, udir, ldir)
+	}
+	return udir, ldir, nil
+}
+
+// renames looks in subdir for local files that are apparently renamed copies
+// of remote files missing locally: a local-only file and a remote-only file
+// with the same size and modification time, where the remote file was in sync
+// at the end of the last clean pass so that its local absence is a removal and
+// not a new arrival. It renames each such remote file to match, sparing a
+// re-upload, and reports whether it renamed any.
+func renames(upc upspin.Client, wd, subdir string, udir []*upspin.DirEntry, ldir []os.FileInfo) (bool, error) {
+	local := make(map[string]bool)
+	for _, fi := range ldir {
+		local[fi.Name()] = true
+	}
+	remote := make(map[string]bool)
+	for _, e := range udir {
+		remote[string(e.SignedName)[len(wd)+1+len(subdir):]] = true
+	}
+
+	// Candidate new and old names, by size and time. A match with more
+	// than one candidate on either side is ambiguous and left alone.
+	added := make(map[sizeTime]string)
+	removed := make(map[sizeTime]string)
+	ambiguous := make(map[sizeTime]bool)
+	for _, fi := range ldir {
+		if !fi.Mode().IsRegular() || remote[fi.Name()] || placeholders[subdir+fi.Name()] {
+			continue
+		}
+		k := sizeTime{fi.Size(), fi.ModTime().Unix()}
+		if _, dup := added[k]; dup {
+			ambiguous[k] = true
+		}
+		added[k] = fi.Name()
+	}
+	for _, e := range udir {
+		name := string(e.SignedName)[len(wd)+1+len(subdir):]
+		if local[name] || e.Attr != upspin.AttrNone || !lastSynced[subdir+name] {
+			continue
+		}
+		size, err := e.Size()
+		if err != nil {
+			continue
+		}
+		k := sizeTime{size, int64(e.Time)}
+		if _, dup := removed[k]; dup {
+			ambiguous[k] = true
+		}
+		removed[k] = name
+	}
+
+	renamed := false
+	for k, name := range removed {
+		newName, ok := added[k]
+		if !ok || ambiguous[k] {
+			continue
+		}
+		oldPath := upspin.PathName(wd + "/" + subdir + name)
+		newPath := upspin.PathName(wd + "/" + subdir + newName)
+		fmt.Println("rename", subdir+name, subdir+newName)
+		_, err := upc.PutDuplicate(oldPath, newPath)
+		if err != nil {
+			return renamed, err
+		}
+		err = upc.SetTime(newPath, upspin.Time(k.time))
+		if err != nil {
+			return renamed, err
+		}
+		err = upc.Delete(oldPath)
+		if err != nil {
+			return renamed, err
+		}
+		renamed = true
+	}
+	return renamed, nil
+}
+
+// lock takes an exclusive lock on lockName in the current directory, failing
+// if another upsync running there holds it. The lock belongs to the open file,
+// so the operating system releases it if upsync is killed or crashes. The file
+// itself, which records the holder's pid, is left in place; the returned
+// function releases the lock.
+func lock() (unlock func(), err error) {
+	f, err := os.OpenFile(lockName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		pid, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err == errLocked {
+			return nil, fmt.Errorf("another upsync (pid %s) holds %s",
+				strings.TrimSpace(string(pid)), lockName)
+		}
+		return nil, fmt.Errorf("locking %s: %v", lockName, err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = fmt.Fprintln(f, os.Getpid())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// withoutPrivate removes upsync's own files from the top level directory
+// listings, so they are never synced in either direction.
+func withoutPrivate(wd string, udir []*upspin.DirEntry, ldir []os.FileInfo) ([]*upspin.DirEntry, []os.FileInfo) {
+	var u []*upspin.DirEntry
+	for _, e := range udir {
+		if !strings.HasPrefix(string(e.SignedName), wd+"/"+privatePrefix) {
+			u = append(u, e)
+		}
+	}
+	var l []os.FileInfo
+	for _, fi := range ldir {
+		if !strings.HasPrefix(fi.Name(), privatePrefix) {
+			l = append(l, fi)
+		}
+	}
+	return u, l
+}
+
+// loadPlaceholders reads the placeholders recorded by the previous upsync.
+func loadPlaceholders() error {
+	b, err := ioutil.ReadFile(placeholdersName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			placeholders[line] = true
+		}
+	}
 	return nil
 }
 
-// pull copies pathname from Upspin to local disk, copying the modification time.
-func pull(upc upspin.Client, wd, pathname string, utime int64) error {
-	fmt.Println("pull", pathname)
-	// TODO(ehg) If we ever decide to parallelize, or even if we decide to
-	// run on small memory machines, switch to io.Copy().
-	bytes, err := upc.Get(upspin.PathName(wd + "/" + pathname))
+// loadSynced reads the files recorded by the last clean upsync.
+func loadSynced() error {
+	b, err := ioutil.ReadFile(syncedName)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(pathname, bytes, 0600)
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			lastSynced[line] = true
+		}
+	}
+	return nil
+}
+
+// saveSynced records lastSynced for the next upsync.
+func saveSynced() error {
+	var names []string
+	for name := range lastSynced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return ioutil.WriteFile(syncedName, []byte(strings.Join(names, "\n")+"\n"), 0600)
+}
+
+// savePlaceholders records the current placeholders for the next upsync.
+func savePlaceholders() error {
+	if len(placeholders) == 0 {
+		err := os.Remove(placeholdersName)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var names []string
+	for name := range placeholders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return ioutil.WriteFile(placeholdersName, []byte(strings.Join(names, "\n")+"\n"), 0600)
+}
+
+// loadManifest reads the manifest left by an interrupted upsync, if any.
+func loadManifest() error {
+	b, err := ioutil.ReadFile(manifestName)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	mtime := time.Unix(utime, 0)
-	err = os.Chtimes(pathname, mtime, mtime)
+	for _, line := range strings.Split(string(b), "\n") {
+		var pr pushRecord
+		var n int
+		// A line cut short by the interruption fails to parse and is ignored.
+		if _, err := fmt.Sscanf(line, "%d %d %d %n", &pr.size, &pr.time, &pr.seq, &n); err != nil || n >= len(line) {
+			continue
+		}
+		manifest[line[n:]] = pr
+	}
+	if len(manifest) > 0 {
+		log.Printf("resuming interrupted upsync; %d files already pushed", len(manifest))
+	}
+	return nil
+}
+
+// openManifest opens the manifest for recording the pushes of a sync pass.
+func openManifest() error {
+	f, err := os.OpenFile(manifestName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		return err
 	}
+	manifestFile = f
 	return nil
 }
 
-// pull copies pathname from local disk to Upspin, copying the modification time.
-func push(upc upspin.Client, wd, pathname string, ltime int64) error {
-	if ltime < lastUpsync {
-		fmt.Printf("skipping old %v %v\n", pathname, ltime)
+// closeManifest closes the manifest, leaving it for a rerun to resume from.
+func closeManifest() {
+	if manifestFile != nil {
+		manifestFile.Close()
+		manifestFile = nil
+	}
+}
+
+// removeManifest closes and removes the manifest after a clean sync pass.
+func removeManifest() error {
+	closeManifest()
+	manifest = make(map[string]pushRecord)
+	err := os.Remove(manifestName)
+	if os.IsNotExist(err) {
 		return nil
 	}
-	fmt.Println("push", pathname)
-	bytes, err := ioutil.ReadFile(pathname)
+	return err
+}
+
+// record adds pathname, just pushed as entry seq, to the manifest, if it is
+// open. The manifest is only an optimization, so failures are logged and
+// otherwise ignored.
+func record(pathname string, seq int64) {
+	if manifestFile == nil {
+		return
+	}
+	fi, err := os.Stat(pathname)
+	if err == nil {
+		pr := pushRecord{sizeTime{fi.Size(), fi.ModTime().Unix()}, seq}
+		manifest[pathname] = pr
+		_, err = fmt.Fprintf(manifestFile, "%d %d %d %s\n", pr.size, pr.time, pr.seq, pathname)
+	}
+	if err != nil {
+		log.Printf("manifest: %v", err)
+	}
+}
+
+// pushed reports whether the manifest shows that pathname was pushed and
+// neither the local file nor its Upspin entry e has changed since.
+func pushed(pathname string, e *upspin.DirEntry) bool {
+	pr, ok := manifest[pathname]
+	if !ok || e.Sequence != pr.seq {
+		return false
+	}
+	fi, err := os.Stat(pathname)
+	return err == nil && fi.Size() == pr.size && fi.ModTime().Unix() == pr.time
+}
+
+// errSkipped is returned by push for files it declines to upload.
+var errSkipped = errors.Str("skipped")
+
+// transfer records the outcome of a pull or push of pathname. A failed transfer
+// is logged and counted but does not stop the upsync of the remaining files.
+// A successful one is counted with the size of the local file.
+func transfer(op, pathname string, err error) {
+	switch {
+	case err == errSkipped:
+	case err != nil:
+		log.Printf("%s %s failed: %v", op, pathname, err)
+		stats.failed++
+	case op == "pull":
+		stats.pulled++
+		stats.pulledBytes += fileSize(pathname)
+		synced[pathname] = true
+	default:
+		stats.pushed++
+		stats.pushedBytes += fileSize(pathname)
+		synced[pathname] = true
+	}
+}
+
+// fileSize returns the size of the local file pathname, or 0 if it cannot
+// be determined.
+func fileSize(pathname string) int64 {
+	fi, err := os.Stat(pathname)
 	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// abandoned holds the paths whose transfers withTimeout gave up on but which
+// are still running in the background.
+var (
+	abandonedMu sync.Mutex
+	abandoned   = make(map[string]bool)
+)
+
+// withTimeout calls f to transfer pathname, giving up if it has not returned
+// within *timeoutFlag. An abandoned f is left to finish in the background, so
+// f must not touch local files; callers do that only after withTimeout returns
+// successfully. Until an abandoned f finishes, later transfers of the same
+// path fail rather than start another, so that a late Put cannot land on top
+// of a newer one and stalled transfers do not pile up.
+func withTimeout(pathname string, f func() error) error {
+	if *timeoutFlag <= 0 {
+		return f()
+	}
+	abandonedMu.Lock()
+	busy := abandoned[pathname]
+	abandonedMu.Unlock()
+	if busy {
+		return fmt.Errorf("an earlier transfer timed out and is still running")
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- f() }()
+	timer := time.NewTimer(*timeoutFlag)
+	defer timer.Stop()
+	select {
+	case err := <-errc:
 		return err
+	case <-timer.C:
 	}
-	path := upspin.PathName(wd + "/" + pathname)
-	_, err = upc.Put(path, bytes)
+	abandonedMu.Lock()
+	abandoned[pathname] = true
+	abandonedMu.Unlock()
+	go func() {
+		<-errc
+		abandonedMu.Lock()
+		delete(abandoned, pathname)
+		abandonedMu.Unlock()
+	}()
+	return fmt.Errorf("timed out after %v", *timeoutFlag)
+}
+
+// pullAndCount pulls the file of action a and records the outcome with
+// transfer. It returns an error only if the pull was refused because it
+// would leave too little free disk space, which stops the upsync.
+func pullAndCount(upc upspin.Client, wd string, a action) error {
+	err := pull(upc, wd, a.pathname, a.entry)
+	if _, ok := err.(*lowDiskError); ok {
+		return err
+	}
+	transfer("pull", a.pathname, err)
+	return nil
+}
+
+// lowDiskError reports a pull refused because of -min-free.
+type lowDiskError struct {
+	pathname string
+	size     int64 // Size of the file to pull.
+	free     int64 // Free space on the local disk.
+}
+
+func (e *lowDiskError) Error() string {
+	return fmt.Sprintf("pulling %s (%s) would leave %s free on the local disk, less than -min-free=%s",
+		e.pathname, formatSize(e.size), formatSize(e.free-e.size), *minFreeFlag)
+}
+
+// checkFree returns a lowDiskError if pulling pathname, described by entry,
+// would leave less than minFree bytes free on the local disk.
+func checkFree(pathname string, entry *upspin.DirEntry) error {
+	if minFree <= 0 {
+		return nil
+	}
+	size, err := entry.Size()
 	if err != nil {
 		return err
 	}
-	err = upc.SetTime(path, upspin.Time(ltime))
+	free, err := freeSpace(".")
 	if err != nil {
 		return err
 	}
+	if free-size < minFree {
+		return &lowDiskError{pathname: pathname, size: size, free: free}
+	}
 	return nil
 }
 
+// parseSize parses a size in bytes, such as 1048576, 512KB, 500MB, 2G or 1TB.
+// The multiples are powers of 1024.
+func parseSize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if t != "" {
+		if i := strings.IndexByte("KMGT", t[len(t)-1]); i >= 0 {
+			mult <<= 10 * uint(i+1)
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// formatSize formats a size in bytes for people, such as 1.3GB or 12MB,
+// with the same powers of 1024 as parseSize.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 && n > -1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	i := -1
+	for (f >= 1024 || f <= -1024) && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if f < 10 && f > -10 {
+		return fmt.Sprintf("%.1f%cB", f, units[i])
+	}
+	return fmt.Sprintf("%.0f%cB", f, units[i])
+}
+
+// pull copies pathname, described by entry, from Upspin to local disk,
+// copying the modification time. With -cache, content already in the cache
+// is copied from there instead of downloaded.
+func pull(upc upspin.Client, wd, pathname string, entry *upspin.DirEntry) error {
+	if err := checkFree(pathname, entry); err != nil {
+		return err
+	}
+	cached := cacheName(entry)
+	bytes, hit := readCache(cached, entry)
+	if hit {
+		fmt.Println("pull (cached)", pathname)
+	} else {
+		fmt.Println("pull", pathname)
+		// TODO(ehg) If we ever decide to parallelize, or even if we decide to
+		// run on small memory machines, switch to io.Copy().
+		err := withTimeout(pathname, func() error {
+			var err error
+			bytes, err = upc.Get(upspin.PathName(wd + "/" + pathname))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		writeCache(cached, bytes)
+	}
+	// Write to a temporary file and rename it into place, so that an
+	// interrupted pull cannot leave a truncated file with a new mtime,
+	// which the next upsync would push as the newest version.
+	f, err := ioutil.TempFile(".", pullPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(bytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	mtime := time.Unix(int64(entry.Time), 0)
+	err = os.Chtimes(tmp, mtime, mtime)
+	if err == nil {
+		err = os.Rename(tmp, pathname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// cacheName returns the name of the file in the -cache directory that holds
+// the content of entry, or the empty string if there is no cache or nothing
+// to cache. Entries with the same blocks have the same content, so the name
+// is derived from the block locations.
+func cacheName(entry *upspin.DirEntry) string {
+	if *cacheFlag == "" || len(entry.Blocks) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, b := range entry.Blocks {
+		fmt.Fprintf(h, "%s %s %d %d\n", b.Location.Endpoint, b.Location.Reference, b.Offset, b.Size)
+	}
+	return filepath.Join(*cacheFlag, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// readCache returns the content of entry held in the cache file cached,
+// and reports whether it was found there intact.
+func readCache(cached string, entry *upspin.DirEntry) ([]byte, bool) {
+	if cached == "" {
+		return nil, false
+	}
+	bytes, err := ioutil.ReadFile(cached)
+	if err != nil {
+		return nil, false
+	}
+	if size, err := entry.Size(); err != nil || size != int64(len(bytes)) {
+		return nil, false
+	}
+	return bytes, true
+}
+
+// writeCache stores bytes in the cache file cached, if any. The cache is
+// only an optimization, so failures are logged and otherwise ignored.
+func writeCache(cached string, bytes []byte) {
+	if cached == "" {
+		return
+	}
+	f, err := ioutil.TempFile(*cacheFlag, "tmp")
+	if err != nil {
+		log.Printf("cache: %v", err)
+		return
+	}
+	_, err = f.Write(bytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Rename into place so a cache file is never seen partly written.
+		err = os.Rename(f.Name(), cached)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("cache: %v", err)
+	}
+}
+
+// push copies pathname from local disk to Upspin, copying the modification
+// time. It returns the entry created by the upload, if that succeeded, even
+// when setting the mtime then failed.
+func push(upc upspin.Client, wd, pathname string, ltime int64) (*upspin.DirEntry, error) {
+	if ltime < lastUpsync {
+		fmt.Printf("skipping old %v %v\n", pathname, ltime)
+		return nil, errSkipped
+	}
+	fmt.Println("push", pathname)
+	bytes, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	path := upspin.PathName(wd + "/" + pathname)
+	var e *upspin.DirEntry
+	err = withTimeout(pathname, func() error {
+		var err error
+		e, err = upc.Put(path, bytes)
+		return err
+	})
+	if err != nil {
+		// e is not safe to read if the Put was abandoned.
+		return nil, err
+	}
+	return e, withTimeout(pathname, func() error {
+		return upc.SetTime(path, upspin.Time(ltime))
+	})
+}
+
 // upspinDir is copied from upspin.io/flags/flags.go.
 func upspinDir(subdir string) string {
 	home, err := config.Homedir()
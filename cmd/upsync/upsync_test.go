@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"upspin.io/bind"
 	"upspin.io/client"
@@ -159,3 +161,318 @@ func TestSync(t *testing.T) {
 		t.Fatalf("expected %d files, saw %d\n", len(testfiles), len(fi))
 	}
 }
+
+// fileInfo is a local directory entry for testing plan.
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime int64
+}
+
+func (f fileInfo) Name() string       { return f.name }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() os.FileMode  { return f.mode }
+func (f fileInfo) ModTime() time.Time { return time.Unix(f.mtime, 0) }
+func (f fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+const planWd = "ann@example.com"
+
+func remote(name string, attr upspin.Attribute, mtime int64) *upspin.DirEntry {
+	return &upspin.DirEntry{
+		Name:       upspin.PathName(planWd + "/" + name),
+		SignedName: upspin.PathName(planWd + "/" + name),
+		Attr:       attr,
+		Time:       upspin.Time(mtime),
+	}
+}
+
+func local(name string, size, mtime int64) os.FileInfo {
+	return fileInfo{name: name, size: size, mode: 0600, mtime: mtime}
+}
+
+func localDir(name string) os.FileInfo {
+	return fileInfo{name: name, mode: os.ModeDir | 0700}
+}
+
+// planned is the part of an action checked by TestPlan.
+type planned struct {
+	op       op
+	pathname string
+}
+
+var bigFile = func() *upspin.DirEntry {
+	e := remote("big", upspin.AttrNone, 10)
+	e.Blocks = make([]upspin.DirBlock, 51)
+	return e
+}()
+
+var planTests = []struct {
+	name         string
+	subdir       string
+	udir         []*upspin.DirEntry
+	ldir         []os.FileInfo
+	placeholders map[string]bool
+	want         []planned
+	wantErr      bool
+}{
+	{
+		name: "empty",
+	},
+	{
+		name: "new remote file",
+		udir: []*upspin.DirEntry{remote("f", upspin.AttrNone, 10)},
+		want: []planned{{opPull, "f"}},
+	},
+	{
+		name: "new local file",
+		ldir: []os.FileInfo{local("f", 1, 10)},
+		want: []planned{{opPush, "f"}},
+	},
+	{
+		name: "newest wins",
+		udir: []*upspin.DirEntry{
+			remote("a", upspin.AttrNone, 20),
+			remote("b", upspin.AttrNone, 10),
+			remote("c", upspin.AttrNone, 10),
+		},
+		ldir: []os.FileInfo{
+			local("a", 1, 10),
+			local("b", 1, 20),
+			local("c", 1, 10),
+		},
+		want: []planned{{opPull, "a"}, {opPush, "b"}, {opInSync, "c"}},
+	},
+	{
+		name: "interleaved",
+		udir: []*upspin.DirEntry{
+			remote("a", upspin.AttrNone, 10),
+			remote("c", upspin.AttrNone, 10),
+		},
+		ldir: []os.FileInfo{
+			local("b", 1, 10),
+			local("d", 1, 10),
+		},
+		want: []planned{{opPull, "a"}, {opPush, "b"}, {opPull, "c"}, {opPush, "d"}},
+	},
+	{
+		name:   "subdirectory",
+		subdir: "d/",
+		udir: []*upspin.DirEntry{
+			remote("d/x", upspin.AttrNone, 10),
+			remote("d/y", upspin.AttrNone, 10),
+		},
+		ldir: []os.FileInfo{local("x", 1, 10)},
+		want: []planned{{opInSync, "d/x"}, {opPull, "d/y"}},
+	},
+	{
+		name: "directories",
+		udir: []*upspin.DirEntry{
+			remote("d1", upspin.AttrDirectory, 0),
+			remote("d2", upspin.AttrDirectory, 0),
+		},
+		ldir: []os.FileInfo{localDir("d2"), localDir("d3")},
+		want: []planned{{opMkdirLocal, "d1"}, {opDescend, "d2"}, {opMkdirRemote, "d3"}},
+	},
+	{
+		name:    "remote directory, local file",
+		udir:    []*upspin.DirEntry{remote("x", upspin.AttrDirectory, 0)},
+		ldir:    []os.FileInfo{local("x", 1, 10)},
+		wantErr: true,
+	},
+	{
+		name:    "remote file, local directory",
+		udir:    []*upspin.DirEntry{remote("x", upspin.AttrNone, 10)},
+		ldir:    []os.FileInfo{localDir("x")},
+		wantErr: true,
+	},
+	{
+		name:    "local symlink",
+		ldir:    []os.FileInfo{fileInfo{name: "s", mode: os.ModeSymlink | 0777}},
+		wantErr: true,
+	},
+	{
+		name: "remote link",
+		udir: []*upspin.DirEntry{remote("l", upspin.AttrLink, 10)},
+		want: []planned{{opSkipLink, "l"}},
+	},
+	{
+		name: "big remote file",
+		udir: []*upspin.DirEntry{bigFile},
+		want: []planned{{opSkipBig, "big"}},
+	},
+	{
+		name: "unreadable remote file",
+		udir: []*upspin.DirEntry{remote("u", upspin.AttrIncomplete, 10)},
+		want: []planned{{opPlaceholder, "u"}},
+	},
+	{
+		name:         "still unreadable",
+		udir:         []*upspin.DirEntry{remote("u", upspin.AttrIncomplete, 10)},
+		ldir:         []os.FileInfo{local("u", 0, 20)},
+		placeholders: map[string]bool{"u": true},
+		want:         []planned{{opKeepPlaceholder, "u"}},
+	},
+	{
+		name: "unrecorded placeholder",
+		udir: []*upspin.DirEntry{remote("u", upspin.AttrIncomplete, 10)},
+		ldir: []os.FileInfo{local("u", 0, 20)},
+		want: []planned{{opKeepPlaceholder, "u"}},
+	},
+	{
+		name: "local content for unreadable file",
+		udir: []*upspin.DirEntry{remote("u", upspin.AttrIncomplete, 10)},
+		ldir: []os.FileInfo{local("u", 5, 20)},
+		want: []planned{{opPush, "u"}},
+	},
+	{
+		name:         "access granted",
+		udir:         []*upspin.DirEntry{remote("u", upspin.AttrNone, 10)},
+		ldir:         []os.FileInfo{local("u", 0, 20)},
+		placeholders: map[string]bool{"u": true},
+		want:         []planned{{opReplacePlaceholder, "u"}},
+	},
+	{
+		name:         "unreadable file removed",
+		ldir:         []os.FileInfo{local("u", 0, 20)},
+		placeholders: map[string]bool{"u": true},
+		want:         []planned{{opRemovePlaceholder, "u"}},
+	},
+}
+
+func TestPlan(t *testing.T) {
+	for _, tt := range planTests {
+		actions, err := plan(planWd, tt.subdir, tt.udir, tt.ldir, tt.placeholders)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: plan succeeded, want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []planned
+		for _, a := range actions {
+			got = append(got, planned{a.op, a.pathname})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: plan = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	const name = "manifest-test"
+	if err := ioutil.WriteFile(name, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	if err := openManifest(); err != nil {
+		t.Fatal(err)
+	}
+	const seq = 42
+	record(name, seq)
+	closeManifest()
+
+	// Reload, as a rerun after an interruption would.
+	manifest = make(map[string]pushRecord)
+	if err := loadManifest(); err != nil {
+		t.Fatal(err)
+	}
+	e := &upspin.DirEntry{Sequence: seq}
+	if !pushed(name, e) {
+		t.Errorf("pushed(%q) = false after reload, want true", name)
+	}
+	if pushed(name, &upspin.DirEntry{Sequence: seq + 1}) {
+		t.Errorf("pushed(%q) = true after remote change, want false", name)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if pushed(name, e) {
+		t.Errorf("pushed(%q) = true after local change, want false", name)
+	}
+
+	if err := removeManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(manifestName); !os.IsNotExist(err) {
+		t.Errorf("manifest still present after removeManifest: %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1048576", 1 << 20, true},
+		{"512KB", 512 << 10, true},
+		{"500MB", 500 << 20, true},
+		{"2g", 2 << 30, true},
+		{"1TB", 1 << 40, true},
+		{"", 0, false},
+		{"MB", 0, false},
+		{"-1MB", 0, false},
+		{"1.5GB", 0, false},
+	} {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1536, "1.5KB"},
+		{12 << 20, "12MB"},
+		{13 << 30 / 10, "1.3GB"},
+		{2048 << 30, "2.0TB"},
+	} {
+		if got := formatSize(tt.in); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWithTimeoutAbandoned(t *testing.T) {
+	defer func(d time.Duration) { *timeoutFlag = d }(*timeoutFlag)
+	*timeoutFlag = 10 * time.Millisecond
+
+	const name = "stalled"
+	release := make(chan struct{})
+	if err := withTimeout(name, func() error { <-release; return nil }); err == nil {
+		t.Fatal("stalled transfer did not time out")
+	}
+	// While the abandoned transfer runs, another of the same path fails
+	// without starting, but other paths are unaffected.
+	if err := withTimeout(name, func() error { t.Error("transfer started"); return nil }); err == nil {
+		t.Error("second transfer of a stalled path succeeded")
+	}
+	if err := withTimeout("other", func() error { return nil }); err != nil {
+		t.Errorf("transfer of another path: %v", err)
+	}
+	close(release)
+	for i := 0; ; i++ {
+		err := withTimeout(name, func() error { return nil })
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("path still busy after abandoned transfer finished: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
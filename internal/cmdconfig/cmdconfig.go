@@ -0,0 +1,77 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cmdconfig loads the Upspin configuration named by a command's
+// -config flag. Besides a file name, the flag may direct the command to
+// read its configuration from standard input or from an environment
+// variable, so that it can run without a config file on disk.
+package cmdconfig // import "exp.upspin.io/internal/cmdconfig"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+const (
+	// Stdin is the -config value that reads the configuration
+	// from standard input.
+	Stdin = "-"
+
+	// EnvPrefix prefixes the name of the environment variable holding
+	// the configuration in a -config value, as in "env:UPSPIN_CONFIG".
+	EnvPrefix = "env:"
+)
+
+// FromFlag returns the configuration named by value, the value of
+// the -config flag. See Read for the values that do not name a file.
+func FromFlag(value string) (upspin.Config, error) {
+	data, ok, err := Read(value)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return config.FromFile(value)
+	}
+	return config.InitConfig(bytes.NewReader(data))
+}
+
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// Read returns the contents of the configuration named by value if it
+// does not name a file, and reports whether that is the case.
+// If value is Stdin, the configuration is read from standard input; it
+// is read only once and later calls return the same contents.
+// If value is EnvPrefix followed by a name, the configuration is the
+// value of the environment variable with that name, which must be set.
+func Read(value string) ([]byte, bool, error) {
+	switch {
+	case value == Stdin:
+		stdin.once.Do(func() {
+			stdin.data, stdin.err = ioutil.ReadAll(os.Stdin)
+		})
+		if stdin.err != nil {
+			return nil, true, fmt.Errorf("reading config from standard input: %v", stdin.err)
+		}
+		return stdin.data, true, nil
+	case strings.HasPrefix(value, EnvPrefix):
+		name := strings.TrimPrefix(value, EnvPrefix)
+		data, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, true, fmt.Errorf("config environment variable %s is not set", name)
+		}
+		return []byte(data), true, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdconfig
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFromEnv(t *testing.T) {
+	const name = "CMDCONFIG_TEST_CONFIG"
+	os.Setenv(name, "username: ann@example.com\n")
+	defer os.Unsetenv(name)
+
+	cfg, err := FromFlag(EnvPrefix + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.UserName(), "ann@example.com"; string(got) != want {
+		t.Errorf("UserName() = %q, want %q", got, want)
+	}
+
+	os.Unsetenv(name)
+	if _, err := FromFlag(EnvPrefix + name); err == nil {
+		t.Errorf("FromFlag succeeded with %s unset", name)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	data, ok, err := Read("/some/config")
+	if ok || data != nil || err != nil {
+		t.Errorf("Read of a file name = %q, %v, %v; want nil, false, nil", data, ok, err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logformat selects the format of the log lines written by a
+// daemon through upspin.io/log: the usual free text, or JSON objects, one
+// per line, for log aggregators. Key events are logged with Event, which
+// adds named fields to the JSON form.
+package logformat // import "exp.upspin.io/internal/logformat"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"upspin.io/flags"
+	"upspin.io/log"
+)
+
+// The formats accepted by Set.
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+var (
+	mu        sync.Mutex
+	out       io.Writer // Destination of JSON lines; nil in text format.
+	component string    // Name of the program, for JSON lines.
+)
+
+// Valid reports whether format is a format accepted by Set.
+func Valid(format string) bool {
+	return format == Text || format == JSON
+}
+
+// Set directs the log output to w in the given format, with JSON lines
+// naming the program as component.
+func Set(format, comp string, w io.Writer) error {
+	if !Valid(format) {
+		return fmt.Errorf("unknown log format %q; want %q or %q", format, Text, JSON)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if format == Text {
+		out = nil
+		log.SetOutput(w)
+		return nil
+	}
+	out, component = w, comp
+	log.SetOutput(lineWriter{})
+	return nil
+}
+
+// Event logs the message text at the given level ("debug", "info" or
+// "error"). In JSON format the line also holds the fields in kv, which
+// alternate names and values, as in Event("info", msg, "file", name).
+func Event(level, text string, kv ...interface{}) {
+	mu.Lock()
+	isJSON := out != nil
+	mu.Unlock()
+	if !isJSON {
+		switch level {
+		case "debug":
+			log.Debug.Print(text)
+		case "info":
+			log.Info.Print(text)
+		default:
+			log.Error.Print(text)
+		}
+		return
+	}
+	if !enabled(level) {
+		return
+	}
+	fields := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	write(level, text, fields)
+}
+
+// levels ranks the logging levels, as set by the -log flag.
+var levels = map[string]int{"debug": 0, "info": 1, "error": 2, "disabled": 3}
+
+// enabled reports whether lines at level are currently logged.
+func enabled(level string) bool {
+	return levels[level] >= levels[flags.Log.String()]
+}
+
+// write writes a JSON line. Fields do not override the standard keys.
+func write(level, text string, fields map[string]interface{}) {
+	line := map[string]interface{}{}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["message"] = text
+	if level != "" {
+		line["level"] = level
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	line["component"] = component
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"message": text, "error": err.Error()})
+	}
+	out.Write(append(b, '\n'))
+}
+
+// timestamp matches the date and time with which upspin.io/log begins lines.
+var timestamp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+// lineWriter receives the free text lines of upspin.io/log in JSON format
+// and writes each as a JSON line. Their level is unknown.
+type lineWriter struct{}
+
+func (lineWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		write("", string(timestamp.ReplaceAll(line, nil)), nil)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"upspin.io/log"
+)
+
+func TestJSON(t *testing.T) {
+	defer Set(Text, "", os.Stderr)
+	log.SetLevel("info")
+	var buf bytes.Buffer
+	if err := Set(JSON, "test", &buf); err != nil {
+		t.Fatal(err)
+	}
+	Event("info", "fixed file", "file", "ann@example.com/f", "readers", 2)
+	Event("debug", "not logged at info level")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v in %q", err, buf.Bytes())
+	}
+	for k, want := range map[string]interface{}{
+		"level":     "info",
+		"component": "test",
+		"message":   "fixed file",
+		"file":      "ann@example.com/f",
+		"readers":   2.0,
+	} {
+		if line[k] != want {
+			t.Errorf("%s = %v, want %v", k, line[k], want)
+		}
+	}
+}
+
+func TestSetUnknown(t *testing.T) {
+	if err := Set("xml", "test", os.Stderr); err == nil {
+		t.Error("Set accepted an unknown format")
+	}
+}